@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+/////////////////
+
+// A chain step with its prompt looked up and its provider ready to go
+type chainStepPlan struct {
+	Step     ChainStep
+	Label    string  // How the step is called in messages and history
+	Prompt   *Prompt // nil for Kagi summaries, which take no prompt
+	Provider Provider
+}
+
+// One step as it is kept in the chain history file
+type ChainStepSave struct {
+	Step     int    `json:"step"`
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+	Model    string `json:"model"`
+	Prompt   string `json:"prompt"`
+	Output   string `json:"output"`
+}
+
+// The chain history file, intermediate outputs included
+type ChainSave struct {
+	Timestamp string          `json:"timestamp"`
+	Chain     string          `json:"chain"`
+	Query     string          `json:"query"`
+	Steps     []ChainStepSave `json:"steps"`
+	Answer    string          `json:"answer"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// The error for a chain step that failed. It unwraps to the step's error,
+// so the exit code stays the one for what went wrong
+type ChainStepError struct {
+	Step  int
+	Total int
+	Name  string
+	Err   error
+}
+
+func (e *ChainStepError) Error() string {
+	return fmt.Sprintf("step %d of %d (%s) failed: %s", e.Step, e.Total, e.Name, e.Err)
+}
+
+func (e *ChainStepError) Unwrap() error {
+	return e.Err
+}
+
+/////////////////
+
+// Build the steps of an ad-hoc chain: the prompts named in -chain, then the
+// -c prompt when there is one
+func chainFromFlags(names string, customPrompt string, literal bool) Prompt {
+	chain := Prompt{Name: "-chain"}
+
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			chain.Steps = append(chain.Steps, ChainStep{Prompt: name})
+		}
+	}
+
+	if customPrompt != "" {
+		chain.Steps = append(chain.Steps, ChainStep{Text: customPrompt, Literal: literal})
+	}
+
+	return chain
+}
+
+// Look up every step's prompt and provider, and fill in its template, before
+// anything is sent, so a typo in the last step does not cost the requests
+// before it. model, from -model, is used for OpenAI steps that do not pick
+// their own
+func planChain(chain Prompt, prompts map[string]Prompt, model string, vars map[string]string, config ThymeConfig) ([]chainStepPlan, error) {
+	plans := make([]chainStepPlan, 0, len(chain.Steps))
+
+	for i, step := range chain.Steps {
+		plan := chainStepPlan{Step: step}
+
+		switch {
+		case step.Prompt != "":
+			prompt, ok := prompts[step.Prompt]
+			if !ok {
+				return nil, fmt.Errorf("step %d of chain %s: there is no prompt called %s, see thyme -l for the list", i+1, chain.Name, step.Prompt)
+			}
+
+			if prompt.isChain() {
+				return nil, fmt.Errorf("step %d of chain %s: %s is a chain, chains cannot run other chains", i+1, chain.Name, step.Prompt)
+			}
+
+			plan.Prompt = &prompt
+			plan.Label = step.Prompt
+
+		case step.Text != "":
+			plan.Prompt = &Prompt{Name: "custom", Text: step.Text, Literal: step.Literal}
+			plan.Label = "custom"
+
+		case step.Provider == "kagi":
+			plan.Label = "kagi summary"
+
+		default:
+			return nil, fmt.Errorf("step %d of chain %s needs a prompt or a text", i+1, chain.Name)
+		}
+
+		if plan.Prompt != nil {
+			if _, err := plan.Prompt.render(vars); err != nil {
+				return nil, fmt.Errorf("step %d of chain %s: %w", i+1, chain.Name, err)
+			}
+
+			// What the step sets wins over the prompt's own defaults
+			if plan.Step.Provider == "" {
+				plan.Step.Provider = plan.Prompt.Defaults.Provider
+			}
+		}
+
+		// Then -model, for the OpenAI steps
+		if plan.Step.Model == "" && (plan.Step.Provider == "" || plan.Step.Provider == "openai") {
+			plan.Step.Model = model
+		}
+
+		// Then the prompt's model, unless the step moved it to another provider
+		if plan.Step.Model == "" && plan.Prompt != nil && (step.Provider == "" || step.Provider == plan.Prompt.Defaults.Provider) {
+			plan.Step.Model = plan.Prompt.Defaults.Model
+		}
+
+		provider, err := newProviderByName(plan.Step.Provider, config)
+		if err != nil {
+			return nil, fmt.Errorf("step %d of chain %s: %w", i+1, chain.Name, err)
+		}
+
+		plan.Provider = provider
+		plans = append(plans, plan)
+	}
+
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("the chain %s has no steps", chain.Name)
+	}
+
+	return plans, nil
+}
+
+/////////////////
+
+// Run a chain of prompts. Each step's output is the next step's input, and
+// only the last output is printed. With SaveQueries every step is kept in a
+// chain history file, also when a step fails
+func runChain(chain Prompt, plans []chainStepPlan, input string, vars PromptVars, filename string, opts QueryOptions) error {
+	save := ChainSave{Chain: chain.Name, Query: input}
+
+	var answer string
+	var references []ProviderReference
+
+	for i, plan := range plans {
+		if !opts.Quiet {
+			fmt.Fprintf(os.Stderr, "Step %d/%d: %s (%s)\n", i+1, len(plans), plan.Label, plan.Provider.Name())
+		}
+
+		req, err := chainStepRequest(plan, input, promptTemplateVars(filename, input, opts.Language, vars))
+
+		// Only the last step's answer has to be in the format asked for
+		if opts.Format == "json" && i == len(plans)-1 {
+			req.Messages = withSystemInstruction(req.Messages, jsonFormatInstruction)
+		}
+
+		if err == nil {
+			var resp ProviderResponse
+			resp, err = completeWithSpinner(plan.Provider, req, opts)
+			answer = removeLeadingNewLines(resp.Answer)
+			references = resp.References
+
+			if err == nil {
+				save.Steps = append(save.Steps, ChainStepSave{
+					Step:     i + 1,
+					Name:     plan.Label,
+					Provider: plan.Provider.Name(),
+					Model:    resp.Model,
+					Prompt:   req.systemPrompt(),
+					Output:   answer,
+				})
+			}
+		}
+
+		if err != nil {
+			err = &ChainStepError{Step: i + 1, Total: len(plans), Name: plan.Label, Err: err}
+
+			if opts.SaveQueries {
+				save.Error = err.Error()
+				saveChainRun(save)
+			}
+
+			return err
+		}
+
+		input = answer
+	}
+
+	if len(references) > 0 {
+		answer += "\n\n" + referencesToString(references)
+	}
+
+	save.Answer = answer
+
+	if opts.SaveQueries {
+		saveChainRun(save)
+	}
+
+	return printAnswer(answer, opts)
+}
+
+// The request for one step, with the prompt filled in for this step's input
+func chainStepRequest(plan chainStepPlan, input string, vars map[string]string) (ProviderRequest, error) {
+	var prompt Prompt
+	if plan.Prompt != nil {
+		rendered, err := plan.Prompt.render(vars)
+		if err != nil {
+			return ProviderRequest{}, err
+		}
+
+		prompt = rendered
+	}
+
+	req := promptRequest(plan.Provider, prompt, input)
+	req.Model = plan.Step.Model
+	req.Parameters.SummaryType = plan.Step.SummaryType
+
+	return req, nil
+}
+
+/////////////////
+
+// Write a chain run to the query history directory
+func saveChainRun(save ChainSave) {
+	saveDir := historyDirForProvider("openai")
+	if saveDir == "" {
+		return
+	}
+
+	filename, _, timestamp := makeSaveNameAndStamps(saveDir, "chain")
+	save.Timestamp = timestamp
+
+	data, err := json.Marshal(save)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		fmt.Println(err)
+	}
+}
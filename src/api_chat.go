@@ -0,0 +1,1217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aymanbagabas/go-osc52/v2"
+)
+
+/////////////////
+
+// A chat conversation and the JSONL file its turns are saved in. The turns
+// make a tree, Turns holds all of them. Messages and Lines are the active
+// branch, as it is sent and as it is saved. The system prompt is kept apart
+// so it can be recorded. When the chat outgrows the model, the messages
+// before Start are no longer sent, Summary can stand in for them
+type ChatSession struct {
+	File     string
+	Model    string
+	System   string
+	Messages []ProviderMessage
+	Lines    []ChatHistoryLine
+	Turns    []ChatHistoryLine
+	Start    int
+	Summary  string
+}
+
+// A new chat, saved in a new file in THYME_QUERY_LOGGING_DIR
+func newChatSession(model string) *ChatSession {
+	saveDir := os.Getenv("THYME_QUERY_LOGGING_DIR")
+	savefilename, _, _ := makeSaveNameAndStamps(saveDir, "chat")
+
+	return &ChatSession{File: savefilename, Model: model}
+}
+
+// Pick up a saved chat where it was left, on the branch used last. The model
+// and system prompt are the last ones the branch records, older files do not
+// record them
+func resumeChatSession(name string) (*ChatSession, error) {
+	filename, err := findChatHistoryFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := readChatHistoryFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := history.ChatHistoryLines
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s has no chat turns to resume", filename)
+	}
+
+	session := &ChatSession{File: filename, Turns: numberChatTurns(lines)}
+
+	branch := activeChatBranch(lines)
+	session.checkout(branch[len(branch)-1].ID)
+
+	for _, line := range session.Lines {
+		if line.Model != "" {
+			session.Model = line.Model
+		}
+
+		if line.System != "" {
+			session.System = line.System
+		}
+	}
+
+	return session, nil
+}
+
+// The question of a turn as it is sent. Only the names of chatted about files
+// are saved, they are sent again as long as they are still there
+func (line ChatHistoryLine) message() string {
+	if files := line.chatFiles(); len(files) > 0 {
+		if message, err := fileChatMessage(files); err == nil {
+			return message
+		}
+	}
+
+	return line.Query
+}
+
+// The request for the next answer, with the system prompt and the summary
+// of what was left out in front
+func (s *ChatSession) request() ProviderRequest {
+	messages := s.Messages[s.Start:]
+
+	system := s.System
+	if s.Summary != "" {
+		system = strings.TrimSpace(system + "\n\nA summary of the conversation so far:\n" + s.Summary)
+	}
+
+	if system != "" {
+		messages = withSystemInstruction(messages, system)
+	}
+
+	return ProviderRequest{Model: s.Model, Messages: messages}
+}
+
+// The ID of the last turn on the active branch, 0 before the first one
+func (s *ChatSession) head() int {
+	if len(s.Lines) == 0 {
+		return 0
+	}
+
+	return s.Lines[len(s.Lines)-1].ID
+}
+
+// Make the branch that ends with the turn the active one, 0 goes back to
+// before the first turn. What was left out of the old branch starts over
+func (s *ChatSession) checkout(id int) {
+	s.Lines = chatBranch(s.Turns, id)
+	s.Messages = []ProviderMessage{}
+
+	for _, line := range s.Lines {
+		s.Messages = append(s.Messages,
+			ProviderMessage{Role: "user", Content: line.message()},
+			ProviderMessage{Role: "assistant", Content: line.Answer},
+		)
+	}
+
+	s.Start = 0
+	s.Summary = ""
+}
+
+// Add a finished turn after the active branch's last one and append it to the
+// chat file. sent is the question as it was sent, line.Query what is saved of it
+func (s *ChatSession) addTurn(sent string, line ChatHistoryLine) {
+	line.Model = s.Model
+	line.System = s.System
+	line.Parent = s.head()
+	line.ID = 1
+	if len(s.Turns) > 0 {
+		line.ID = s.Turns[len(s.Turns)-1].ID + 1
+	}
+
+	s.Messages = append(s.Messages,
+		ProviderMessage{Role: "user", Content: sent},
+		ProviderMessage{Role: "assistant", Content: line.Answer},
+	)
+	s.Lines = append(s.Lines, line)
+	s.Turns = append(s.Turns, line)
+
+	saveChat(line, s.File)
+}
+
+// Take the last turn of the active branch back, and out of the chat file.
+// A turn that other branches go on from stays for them
+func (s *ChatSession) dropTurn() {
+	last := s.Lines[len(s.Lines)-1]
+
+	if len(chatChildren(s.Turns, last.ID)) == 0 {
+		for i, turn := range s.Turns {
+			if turn.ID == last.ID {
+				s.Turns = append(s.Turns[:i], s.Turns[i+1:]...)
+				break
+			}
+		}
+	}
+
+	start, summary := s.Start, s.Summary
+	s.checkout(last.Parent)
+
+	s.Start, s.Summary = start, summary
+	if s.Start > len(s.Messages) {
+		s.Start = len(s.Messages)
+	}
+
+	s.rewrite()
+}
+
+// Write the chat file again with the turns we have now, the active branch's
+// last turn last. They go to a new file that then takes the old one's place,
+// so the chat is never lost halfway
+func (s *ChatSession) rewrite() {
+	head := s.head()
+
+	turns := []ChatHistoryLine{}
+	for _, turn := range s.Turns {
+		if turn.ID != head {
+			turns = append(turns, turn)
+		}
+	}
+
+	if head != 0 {
+		turns = append(turns, s.Lines[len(s.Lines)-1])
+	}
+
+	if len(turns) == 0 {
+		if err := os.Remove(s.File); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	var data []byte
+	for _, turn := range turns {
+		line, err := json.Marshal(turn)
+		if err != nil {
+			fmt.Println(err.Error())
+			return
+		}
+
+		data = append(append(data, line...), '\n')
+	}
+
+	if err := replaceFile(s.File, data); err != nil {
+		fmt.Println(err.Error())
+	}
+}
+
+// Write a file through a temporary one next to it, which is renamed over it
+// once it is complete
+func replaceFile(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	// Gone after the rename, or left over from a failed write
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
+
+// How many question and answer turns the active branch has so far
+func (s *ChatSession) turns() int {
+	return len(s.Lines)
+}
+
+// Remind the user where a resumed chat left off with its last turn. Quiet
+// chats get it without styles
+func printResumedChat(s *ChatSession, opts QueryOptions) {
+	styles := getFontStyles()
+	info := func(text string) string {
+		if opts.Quiet {
+			return text
+		}
+		return styles.historyInfo.Render(text)
+	}
+
+	fmt.Println(info(fmt.Sprintf("Resuming %s, %d turns with %s", s.File, s.turns(), s.Model)))
+	if s.System != "" {
+		fmt.Println(info("System: ") + s.System)
+	}
+	if ends := chatBranchEnds(s.Turns, s.head()); len(ends) > 1 {
+		fmt.Println(info(fmt.Sprintf("The chat has %d branches, /branches lists them", len(ends))))
+	}
+	fmt.Println()
+
+	printLastChatTurn(s, opts)
+}
+
+// Show the last question and answer of the active branch. Quiet chats get
+// the answer as it is, without highlighting
+func printLastChatTurn(s *ChatSession, opts QueryOptions) {
+	if s.turns() == 0 {
+		return
+	}
+
+	// Cut long questions by characters, a byte cut could split one
+	query := s.Messages[len(s.Messages)-2].Content
+	if runes := []rune(query); len(runes) > 300 {
+		query = string(runes[:300]) + "..."
+	}
+
+	answer := s.Messages[len(s.Messages)-1].Content
+
+	if opts.Quiet {
+		fmt.Print("-> ")
+	} else {
+		prettyPrintChatArrow("-> ")
+		answer = formatCodeBlocksInMarkdown(answer, "")
+	}
+
+	fmt.Println(query)
+	fmt.Println("---")
+	fmt.Println(answer)
+	fmt.Println()
+}
+
+/////////////////
+
+// Handle a chat interaction with the GPT API. Returns when the user leaves
+// with /exit or Ctrl-D, or if the conversation about the files could not be
+// started
+func gptChat(provider Provider, session *ChatSession, config ThymeConfig, opts QueryOptions, files ...string) error {
+	editor := newLineEditor(inputHistoryFile())
+	fmt.Println("Conversation")
+	fmt.Println("---------------------")
+
+	// Show where a resumed chat left off, or what a new one was told
+	if session.turns() > 0 {
+		printResumedChat(session, opts)
+	} else if session.System != "" {
+		chatInfo("System: %s", session.System)
+	}
+
+	chat := newChatREPL(provider, session, config, opts)
+	chat.editor = editor
+
+	// If we're chatting about files, send them all first and show what the
+	// model makes of them
+	if len(files) > 0 {
+		sent, err := fileChatMessage(files)
+		if err != nil {
+			return err
+		}
+
+		chatInfo("%s", fileChatSummary(session.Model, files))
+
+		// We just save the filenames so we dont just create a copy of
+		// Giant files
+		line := ChatHistoryLine{
+			Query: fmt.Sprintf("%s %s", fileChatPrompt, strings.Join(files, ", ")),
+			Files: files,
+		}
+
+		if !chat.send(sent, line) {
+			return errors.New("the chat about the files could not be started")
+		}
+	}
+
+	for {
+		text, err := editor.readInput(chat.arrow())
+
+		// Ctrl-D and Ctrl-C leave the chat like /exit
+		if err == io.EOF || err == errInputCancelled {
+			fmt.Println()
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		fmt.Println("---")
+
+		if isChatCommand(text) {
+			if chat.run(chat.command(text)) {
+				return nil
+			}
+			continue
+		}
+
+		// /edit without the new question asks for it next
+		if chat.editing > 0 {
+			turn := chat.editing
+			chat.editing = 0
+			chat.run(chat.edit(turn, strings.TrimPrefix(text, "/")))
+			continue
+		}
+
+		chat.ask(strings.TrimPrefix(text, "/"))
+	}
+}
+
+/////////////////
+
+// What the chat loop keeps between turns besides the session
+type chatREPL struct {
+	provider    Provider
+	session     *ChatSession
+	editor      *lineEditor
+	opts        QueryOptions
+	attachments []string // Files /file attached to the next question
+	editing     int      // The turn /edit is waiting for the new question of
+	strategy    string   // What to do when the chat outgrows the model
+	config      ThymeConfig
+	limits      map[string]int // Context windows that turned out smaller than we thought
+	keys        string         // The keys of the front end, for /help
+
+	// How the chat tells the user about its context, and asks for a
+	// summary. The line mode prints and shows the spinner, the TUI does not
+	warn      func(format string, a ...interface{})
+	summarize func(req ProviderRequest) (ProviderResponse, error)
+}
+
+func newChatREPL(provider Provider, session *ChatSession, config ThymeConfig, opts QueryOptions) *chatREPL {
+	return &chatREPL{
+		provider: provider,
+		session:  session,
+		opts:     opts,
+		strategy: config.ContextStrategy,
+		config:   config,
+		limits:   map[string]int{},
+		keys:     chatLineKeys,
+		warn:     chatWarning,
+		summarize: func(req ProviderRequest) (ProviderResponse, error) {
+			return completeWithSpinner(provider, req, opts)
+		},
+	}
+}
+
+// The prompt arrow, with how much of the model's context the chat uses
+func (c *chatREPL) arrow() string {
+	used, exact := countMessagesTokens(c.session.Model, c.session.request().Messages)
+	limit := c.contextLimit()
+	usage := fmt.Sprintf("[%s/%s] ", formatCountedTokens(used, exact), formatTokenCount(limit))
+
+	if c.editing > 0 {
+		usage += fmt.Sprintf("edit turn %d ", c.editing)
+	}
+
+	if used > (limit-answerReserve(limit))*4/5 {
+		return getFontStyles().chatWarning.Render(usage) + spinnerText.Render("-> ")
+	}
+
+	return spinnerText.Render(usage + "-> ")
+}
+
+// Send a question, with the attached files in front, and keep the answer
+func (c *chatREPL) ask(text string) {
+	sent, err := c.withAttachments(text)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	if c.send(sent, ChatHistoryLine{Query: sent}) {
+		c.attachments = nil
+	}
+}
+
+// Ask a turn of the active branch again with a new question. The old turn and
+// what followed it stay on their own branch
+func (c *chatREPL) edit(turn int, text string) chatCommandResult {
+	if strings.TrimSpace(text) == "" {
+		return chatCommandResult{note: fmt.Sprintf("Left turn %d as it was", turn)}
+	}
+
+	if turn > c.session.turns() {
+		return chatCommandResult{note: fmt.Sprintf("This branch has no turn %d", turn)}
+	}
+
+	sent, err := c.withAttachments(text)
+	if err != nil {
+		return chatCommandResult{note: err.Error()}
+	}
+
+	return chatCommandResult{question: &chatQuestion{
+		parent:   c.session.Lines[turn-1].Parent,
+		sent:     sent,
+		line:     ChatHistoryLine{Query: sent},
+		typed:    text,
+		attached: true,
+		kept:     fmt.Sprintf("Turn %d and what followed it are kept on another branch, /branches lists them", turn),
+	}}
+}
+
+// The question with the files /file attached in front
+func (c *chatREPL) withAttachments(text string) (string, error) {
+	if len(c.attachments) == 0 {
+		return text, nil
+	}
+
+	parts := []string{}
+	for _, path := range c.attachments {
+		attachment, err := fileAttachment(path)
+		if err != nil {
+			return "", err
+		}
+
+		parts = append(parts, attachment)
+	}
+
+	return strings.Join(append(parts, text), "\n\n"), nil
+}
+
+// Ask a question after an earlier turn, 0 for the start of the chat, which
+// starts a new branch there. If it fails the chat stays on the branch it was
+func (c *chatREPL) branchFrom(parent int, sent string, line ChatHistoryLine) bool {
+	session := c.session
+	head, start, summary := session.head(), session.Start, session.Summary
+
+	session.checkout(parent)
+
+	if c.send(sent, line) {
+		return true
+	}
+
+	session.checkout(head)
+	session.Start, session.Summary = start, summary
+
+	return false
+}
+
+// Stream the answer to a question and add the turn. Returns false if it
+// failed, in which case the question is not kept
+func (c *chatREPL) send(sent string, line ChatHistoryLine) bool {
+	content, interrupted, asked, err := c.answer(sent, func(req ProviderRequest) (string, bool, error) {
+		return streamChatTurn(c.provider, req, c.opts)
+	})
+
+	if err != nil {
+		fmt.Println(describeError(err))
+		return false
+	}
+
+	if !asked {
+		return false
+	}
+
+	if interrupted {
+		prettyPrintChatArrow("[interrupted]\n")
+	}
+
+	// Keep the reply, even a partial one, so the conversation stays in order
+	line.Answer = content
+	c.session.addTurn(sent, line)
+
+	return true
+}
+
+// Get the answer to a question after the active branch, with stream, once
+// the chat fits the model. asked is false when the question could not be
+// sent. The session is as it was afterwards, the turn is not added
+func (c *chatREPL) answer(sent string, stream func(req ProviderRequest) (string, bool, error)) (string, bool, bool, error) {
+	c.session.Messages = append(c.session.Messages, ProviderMessage{
+		Role:    "user",
+		Content: sent,
+	})
+
+	var content string
+	var interrupted, asked bool
+	var err error
+
+	// When the model says the chat is too long after all, our count was
+	// off. Make the window smaller and try once more
+	for attempt := 0; attempt < 2; attempt++ {
+		if !c.fitContext() {
+			break
+		}
+
+		asked = true
+		content, interrupted, err = stream(c.session.request())
+
+		var perr *ProviderError
+		if !errors.As(err, &perr) || perr.Kind != ErrorContextLength || c.strategy == "refuse" {
+			break
+		}
+
+		c.limits[c.session.Model] = c.contextLimit() * 3 / 4
+	}
+
+	// The question is only kept together with its answer, so one that
+	// failed is not sent twice. The conversation carries on
+	c.session.Messages = c.session.Messages[:len(c.session.Messages)-1]
+
+	return content, interrupted, asked, err
+}
+
+/////////////////
+
+// The context window of the chat's model
+func (c *chatREPL) contextLimit() int {
+	if limit, ok := c.limits[c.session.Model]; ok {
+		return limit
+	}
+
+	return contextWindow(c.session.Model, c.config)
+}
+
+// Make sure the next request leaves room for the answer, by the chat's
+// strategy. Returns false when the question cannot be sent
+func (c *chatREPL) fitContext() bool {
+	session := c.session
+	limit := c.contextLimit()
+	budget := limit - answerReserve(limit)
+
+	used, _ := countMessagesTokens(session.Model, session.request().Messages)
+	if used <= budget {
+		return true
+	}
+
+	if c.strategy == "refuse" {
+		c.warn("This would make the chat about %d tokens, %s fits %d with room for the answer. /undo, /clear or /context drop make room.", used, session.Model, budget)
+		return false
+	}
+
+	if c.strategy == "summarize" && c.summarizeContext(budget) {
+		return true
+	}
+
+	// Leave out the oldest turns, but never the question itself
+	start, summary := session.Start, session.Summary
+	dropped := 0
+
+	for used > budget && session.Start < len(session.Messages)-1 {
+		session.Start += 2
+		dropped++
+
+		// The summary is of turns we have now left out
+		session.Summary = ""
+		used, _ = countMessagesTokens(session.Model, session.request().Messages)
+	}
+
+	if used > budget {
+		session.Start, session.Summary = start, summary
+		c.warn("Your message alone is about %d tokens, %s fits %d with room for the answer.", used, session.Model, budget)
+		return false
+	}
+
+	c.warn("Left out the %d oldest turns, the chat no longer fit %s's %d tokens.", dropped, session.Model, limit)
+	return true
+}
+
+// Summarize the turns before the last one into a system note, which keeps
+// their gist for the model. Returns false if it did not make the chat fit
+func (c *chatREPL) summarizeContext(budget int) bool {
+	session := c.session
+
+	// The question and the turn before it stay as they are
+	end := len(session.Messages) - 3
+	if end <= session.Start {
+		return false
+	}
+
+	transcript := []string{}
+	if session.Summary != "" {
+		transcript = append(transcript, "Earlier: "+session.Summary)
+	}
+
+	for _, message := range session.Messages[session.Start:end] {
+		transcript = append(transcript, message.Role+": "+message.Content)
+	}
+
+	// The turns to summarize have to fit too, the oldest go first
+	for len(transcript) > 1 {
+		if tokens, _ := countTokens(session.Model, strings.Join(transcript, "\n\n")); tokens <= budget {
+			break
+		}
+
+		transcript = transcript[1:]
+	}
+
+	req := ProviderRequest{
+		Model: session.Model,
+		Messages: []ProviderMessage{
+			{Role: "system", Content: chatSummaryPrompt},
+			{Role: "user", Content: strings.Join(transcript, "\n\n")},
+		},
+	}
+
+	resp, err := c.summarize(req)
+	if err != nil {
+		c.warn("Could not summarize the chat: %s", strings.TrimSpace(describeError(err)))
+		return false
+	}
+
+	turns := (end - session.Start) / 2
+	session.Start = end
+	session.Summary = strings.TrimSpace(resp.Answer)
+
+	if used, _ := countMessagesTokens(session.Model, session.request().Messages); used > budget {
+		return false
+	}
+
+	c.warn("Summarized the %d oldest turns, the chat no longer fit %s's %d tokens.", turns, session.Model, c.contextLimit())
+	return true
+}
+
+const chatSummaryPrompt = "Summarize the conversation below in a few short paragraphs, so it can be carried on without it. Keep names, decisions, code identifiers and open questions, leave out pleasantries."
+
+// How many tokens the chat is, turn by turn, and what that comes to against
+// the model's window. Estimated counts are marked with a ~
+func chatTokens(s *ChatSession, limit int, strategy string) ([]string, string) {
+	count := func(text string) string {
+		return formatCountedTokens(countTokens(s.Model, text))
+	}
+
+	lines := []string{}
+
+	if s.System != "" {
+		lines = append(lines, fmt.Sprintf("System prompt: %s tokens", count(s.System)))
+	}
+
+	if s.Summary != "" {
+		lines = append(lines, fmt.Sprintf("Summary of the left out turns: %s tokens", count(s.Summary)))
+	}
+
+	for i := 0; i+1 < len(s.Messages); i += 2 {
+		line := fmt.Sprintf("Turn %d: %s + %s tokens", i/2+1, count(s.Messages[i].Content), count(s.Messages[i+1].Content))
+
+		if i < s.Start {
+			line += " (left out)"
+		}
+
+		lines = append(lines, line)
+	}
+
+	used, exact := countMessagesTokens(s.Model, s.request().Messages)
+	total := fmt.Sprintf("%s of %s's %d tokens, %d kept for the answer. When the chat outgrows it, thyme will %s.", formatCountedTokens(used, exact), s.Model, limit, answerReserve(limit), contextStrategyDescriptions[strategy])
+
+	return lines, total
+}
+
+// Tell the user something about the chat
+func chatInfo(format string, a ...interface{}) {
+	fmt.Println(getFontStyles().historyInfo.Render(fmt.Sprintf(format, a...)))
+	fmt.Println()
+}
+
+// Warn the user about the chat
+func chatWarning(format string, a ...interface{}) {
+	fmt.Println(getFontStyles().chatWarning.Render(fmt.Sprintf(format, a...)))
+	fmt.Println()
+}
+
+/////////////////
+
+// The chat commands and what they do, for /help
+var chatCommands = [][2]string{
+	{"/model [name]", "Show the model, or switch to another one"},
+	{"/system [text]", "Show the system prompt, or set it"},
+	{"/file <path>", "Attach a file to your next message"},
+	{"/retry", "Ask for the last answer again, the old one is kept on a branch"},
+	{"/edit <turn> [text]", "Ask an earlier question differently, on a new branch"},
+	{"/branches", "List the branches of the chat"},
+	{"/branch <number>", "Switch to another branch"},
+	{"/undo", "Take back the last question and answer"},
+	{"/clear", "Start over in a new chat, keeping the model and system prompt"},
+	{"/save <name>", "Move the chat to <name>-chat.jsonl, it carries on there"},
+	{"/copy [code]", "Copy the last answer, or its last code block, to the clipboard"},
+	{"/tokens", "Count how many tokens the chat is, turn by turn"},
+	{"/context [how]", "Show or set what happens when the chat outgrows the model: drop, summarize or refuse"},
+	{"/exit", "Leave the chat, so do Ctrl-D and Ctrl-C"},
+	{"/help", "Show these commands"},
+}
+
+// What a chat command has to say, and what the chat it was typed in does
+// next. The line mode prints it, the TUI shows it above the box
+type chatCommandResult struct {
+	output   []string      // Lines shown as they are, like the turns /tokens counts
+	note     string        // What the command tells the user
+	exit     bool          // Whether the chat ends
+	question *chatQuestion // A question to ask on a new branch, for /retry and /edit
+	prefill  string        // The old question /edit puts in the input to change
+	switched bool          // Whether the chat is on another branch, its last turn is shown
+}
+
+// A question to ask after an earlier turn, which starts a branch there
+type chatQuestion struct {
+	parent   int
+	sent     string
+	line     ChatHistoryLine
+	typed    string // What was typed, it is given back if the question fails
+	attached bool   // Whether the files /file attached went with it
+	kept     string // What to tell the user once it is answered
+}
+
+// The line mode's keys, for /help
+const chatLineKeys = "Alt-Enter or Ctrl-J starts a new line, a first line of <<EOF takes every line up to EOF, and Ctrl-X Ctrl-E writes the message in $EDITOR. Up and Down go through what you typed before."
+
+// Commands start with a single slash, // sends a message starting with /
+func isChatCommand(text string) bool {
+	return strings.HasPrefix(text, "/") && !strings.HasPrefix(text, "//")
+}
+
+// Run a chat command. What it changes in the chat is done here, the front
+// end shows the result and asks the question it makes
+func (c *chatREPL) command(text string) chatCommandResult {
+	name, arg, _ := strings.Cut(strings.TrimSpace(text), " ")
+	arg = strings.TrimSpace(arg)
+
+	note := func(format string, a ...interface{}) chatCommandResult {
+		return chatCommandResult{note: fmt.Sprintf(format, a...)}
+	}
+
+	session := c.session
+
+	switch name {
+	case "/exit", "/quit":
+		return chatCommandResult{exit: true}
+
+	case "/help":
+		output := []string{}
+		for _, command := range chatCommands {
+			output = append(output, fmt.Sprintf("%-20s %s", command[0], command[1]))
+		}
+
+		return chatCommandResult{output: output, note: c.keys}
+
+	case "/model":
+		if arg != "" {
+			session.Model = c.provider.ResolveModel(arg)
+		}
+		return note("Chatting with %s", session.Model)
+
+	case "/system":
+		if arg != "" {
+			session.System = arg
+		}
+
+		if session.System == "" {
+			return note("There is no system prompt")
+		}
+		return note("System: %s", session.System)
+
+	case "/file":
+		if arg == "" {
+			return note("Which file? /file <path>")
+		}
+
+		if !doesFileExist(arg) {
+			return note("There is no file %s", arg)
+		}
+
+		c.attachments = append(c.attachments, arg)
+		return note("%s goes with your next message", arg)
+
+	case "/retry":
+		if session.turns() == 0 {
+			return note("There is no answer to retry")
+		}
+
+		// The new answer goes next to the old one, which stays on its branch
+		line := session.Lines[len(session.Lines)-1]
+
+		return chatCommandResult{question: &chatQuestion{
+			parent: line.Parent,
+			sent:   session.Messages[len(session.Messages)-2].Content,
+			line:   ChatHistoryLine{Query: line.Query, Files: line.Files},
+			kept:   "The old answer is kept on another branch, /branches lists them",
+		}}
+
+	case "/edit":
+		number, text, _ := strings.Cut(arg, " ")
+
+		turn, err := strconv.Atoi(number)
+		if err != nil || turn < 1 || turn > session.turns() {
+			return note("Which turn? /edit <1-%d> [new question]", session.turns())
+		}
+
+		if strings.TrimSpace(text) != "" {
+			return c.edit(turn, strings.TrimSpace(text))
+		}
+
+		// Without the new question, edit the old one
+		c.editing = turn
+
+		return chatCommandResult{
+			note:    fmt.Sprintf("Change turn %d and press Enter, an empty message leaves it as it was", turn),
+			prefill: session.Lines[turn-1].Query,
+		}
+
+	case "/branches":
+		return c.branches()
+
+	case "/branch":
+		ends := chatBranchEnds(session.Turns, session.head())
+
+		number, err := strconv.Atoi(arg)
+		if err != nil || number < 1 || number > len(ends) {
+			return note("Which branch? /branch <1-%d>, /branches lists them", len(ends))
+		}
+
+		session.checkout(ends[number-1].ID)
+		session.rewrite()
+
+		return chatCommandResult{note: fmt.Sprintf("On branch %d, %d turns", number, session.turns()), switched: true}
+
+	case "/undo":
+		if session.turns() == 0 {
+			return note("There is nothing to undo")
+		}
+
+		session.dropTurn()
+
+		if c.editing > session.turns() {
+			c.editing = 0
+		}
+
+		return note("Took back the last turn, %d left", session.turns())
+
+	case "/clear":
+		system := session.System
+		*session = *newChatSession(session.Model)
+		session.System = system
+		c.attachments = nil
+		c.editing = 0
+		return note("Starting over in %s", session.File)
+
+	case "/save":
+		if arg == "" {
+			return note("Under which name? /save <name>")
+		}
+
+		path := chatSavePath(arg)
+		if doesFileExist(path) {
+			return note("%s already exists", path)
+		}
+
+		if doesFileExist(session.File) {
+			if err := os.Rename(session.File, path); err != nil {
+				return note("Could not save the chat: %s", err)
+			}
+		}
+
+		session.File = path
+		return note("Saved to %s", path)
+
+	case "/copy":
+		if session.turns() == 0 {
+			return note("There is no answer to copy")
+		}
+
+		text := session.Lines[len(session.Lines)-1].Answer
+
+		if arg == "code" {
+			blocks := extractCodeBlocks(text)
+			if len(blocks) == 0 {
+				return note("The last answer has no code")
+			}
+
+			text = blocks[len(blocks)-1]
+		}
+
+		copyToClipboard(text)
+		return note("Copied to the clipboard")
+
+	case "/tokens":
+		output, total := chatTokens(session, c.contextLimit(), c.strategy)
+		return chatCommandResult{output: output, note: total}
+
+	case "/context":
+		if arg != "" {
+			if !isContextStrategy(arg) {
+				return note("Use one of %s", strings.Join(contextStrategies, ", "))
+			}
+
+			c.strategy = arg
+		}
+
+		return note("When the chat outgrows %s's %d tokens, thyme will %s", session.Model, c.contextLimit(), contextStrategyDescriptions[c.strategy])
+	}
+
+	return note("There is no %s, /help lists the commands", name)
+}
+
+// Show what a chat command has to say, and ask the question it makes.
+// Returns true when the chat should end
+func (c *chatREPL) run(result chatCommandResult) bool {
+	for _, line := range result.output {
+		fmt.Println(line)
+	}
+
+	if len(result.output) > 0 {
+		fmt.Println()
+	}
+
+	if result.note != "" {
+		chatInfo("%s", result.note)
+	}
+
+	if result.switched {
+		printLastChatTurn(c.session, c.opts)
+	}
+
+	if result.prefill != "" {
+		c.editor.prefill = result.prefill
+	}
+
+	if q := result.question; q != nil && c.branchFrom(q.parent, q.sent, q.line) {
+		if q.attached {
+			c.attachments = nil
+		}
+
+		chatInfo("%s", q.kept)
+	}
+
+	return result.exit
+}
+
+// List where every branch ends and where it parts from the active one
+func (c *chatREPL) branches() chatCommandResult {
+	session := c.session
+	ends := chatBranchEnds(session.Turns, session.head())
+
+	if len(ends) < 2 {
+		return chatCommandResult{note: "There is only this branch, /edit and /retry start new ones"}
+	}
+
+	output := []string{}
+	for i, end := range ends {
+		branch := chatBranch(session.Turns, end.ID)
+
+		marker, where := " ", "this branch"
+		if end.ID != session.head() {
+			where = fmt.Sprintf("from turn %d", chatForkTurn(branch, session.Lines))
+		} else {
+			marker = "*"
+		}
+
+		output = append(output, fmt.Sprintf("%s %d: %d turns, %s: %s", marker, i+1, len(branch), where, truncateToWidth(end.Query, 50)))
+	}
+
+	return chatCommandResult{output: output}
+}
+
+// Where /save puts a chat. Names without a directory go in
+// THYME_QUERY_LOGGING_DIR, and are marked as chats for -history
+func chatSavePath(name string) string {
+	if strings.ContainsRune(name, filepath.Separator) {
+		return name
+	}
+
+	if !strings.HasSuffix(name, ".jsonl") {
+		name += "-chat.jsonl"
+	}
+
+	return filepath.Join(os.Getenv("THYME_QUERY_LOGGING_DIR"), name)
+}
+
+// Put text on the clipboard with an OSC 52 escape sequence, which most
+// terminals understand, also over SSH and in tmux or screen
+func copyToClipboard(text string) {
+	seq := osc52.New(text)
+
+	term := os.Getenv("TERM")
+	if os.Getenv("TMUX") != "" {
+		seq = seq.Tmux()
+	} else if strings.HasPrefix(term, "screen") {
+		seq = seq.Screen()
+	}
+
+	seq.WriteTo(os.Stderr)
+}
+
+/////////////////
+
+// Send one chat turn and print the reply as it streams in. Ctrl-C cancels only
+// this turn, in which case whatever arrived so far is returned as interrupted
+func streamChatTurn(provider Provider, req ProviderRequest, opts QueryOptions) (string, bool, error) {
+	// Ctrl-C cancels the context while the reply is coming in, the
+	// default handler (exit) is back once we return
+	ctx, cancel := newRequestContext(opts.Timeout)
+	defer cancel()
+
+	// Start the spinner, it stops on the first token. Quiet chats have none
+	spinningComplete := make(chan bool)
+	spinning := !opts.Quiet
+	if spinning {
+		go spinner(spinningComplete)
+	}
+
+	stop := func() {
+		if spinning {
+			stopSpinner(spinningComplete)
+			spinning = false
+		}
+	}
+
+	streamer, ok := provider.(StreamingProvider)
+	if !ok {
+		resp, err := provider.Complete(ctx, req)
+		stop()
+
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			return "", true, nil
+		}
+
+		if err != nil {
+			return "", false, err
+		}
+
+		typeWriterPrint(formatCodeBlocksInMarkdown(resp.Answer, opts.Language)+"\n", false)
+		return resp.Answer, false, nil
+	}
+
+	printer := newMarkdownStreamPrinter(opts.Language, !opts.Quiet)
+
+	resp, err := streamer.Stream(ctx, req, func(token string) {
+		stop()
+		printer.Write(token)
+	})
+
+	stop()
+	printer.Flush()
+	fmt.Printf("\n\n")
+
+	// A cancelled context means the user interrupted us, that is not an error
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return resp.Answer, true, nil
+	}
+
+	return resp.Answer, false, err
+}
+
+/////////////////
+
+const fileChatPrompt = "Hello! We would like to ask some questions about these files, please:"
+
+// The first message of a chat about files, every one with its path and its
+// text as it is
+func fileChatMessage(files []string) (string, error) {
+	parts := []string{fileChatPrompt}
+
+	for _, file := range files {
+		attachment, err := fileAttachment(file)
+		if err != nil {
+			return "", err
+		}
+
+		parts = append(parts, attachment)
+	}
+
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// What is sent, like "Sending main.go, go.mod (1.2k tokens)"
+func fileChatSummary(model string, files []string) string {
+	tokens, exact := 0, true
+	for _, file := range files {
+		count, counted := countTokens(model, readFileToString(file))
+		tokens, exact = tokens+count, exact && counted
+	}
+
+	names := strings.Join(files, ", ")
+	if len(files) > 5 {
+		names = fmt.Sprintf("%s and %d more", strings.Join(files[:5], ", "), len(files)-5)
+	}
+
+	return fmt.Sprintf("Sending %s (%s tokens)", names, formatCountedTokens(tokens, exact))
+}
+
+// The files a saved turn was about that are still there
+func (line ChatHistoryLine) chatFiles() []string {
+	files := []string{}
+
+	for _, file := range line.Files {
+		if doesFileExist(file) {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// A file attached to a chat message, with its path and its text in a code
+// block as it is
+func fileAttachment(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	language := strings.TrimPrefix(filepath.Ext(path), ".")
+
+	return fmt.Sprintf("%s:\n```%s\n%s\n```", path, language, strings.TrimRight(string(data), "\n")), nil
+}
+
+/////////////////
+
+// A chat history file by its path, or the last one written to for "latest"
+func findChatHistoryFile(name string) (string, error) {
+	if name != "latest" {
+		if !doesFileExist(name) {
+			return "", fmt.Errorf("there is no chat history file %s", name)
+		}
+
+		return name, nil
+	}
+
+	saveDir := os.Getenv("THYME_QUERY_LOGGING_DIR")
+	if saveDir == "" {
+		return "", errors.New("set THYME_QUERY_LOGGING_DIR to resume the latest chat")
+	}
+
+	chats, _ := filepath.Glob(filepath.Join(saveDir, "*-chat.jsonl"))
+	if len(chats) == 0 {
+		return "", fmt.Errorf("there are no saved chats in %s", saveDir)
+	}
+
+	// Saved chats can have any name, go by when they were last written
+	modified := map[string]time.Time{}
+	for _, chat := range chats {
+		if info, err := os.Stat(chat); err == nil {
+			modified[chat] = info.ModTime()
+		}
+	}
+
+	sort.SliceStable(chats, func(i, j int) bool {
+		return modified[chats[i]].Before(modified[chats[j]])
+	})
+
+	return chats[len(chats)-1], nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A chat of two turns where the second question was asked again, saved in a
+// temporary file
+func testChatREPL(t *testing.T) *chatREPL {
+	session := &ChatSession{File: filepath.Join(t.TempDir(), "chat.jsonl"), Model: "llama2"}
+
+	session.addTurn("first", ChatHistoryLine{Query: "first", Answer: "one"})
+	session.addTurn("second", ChatHistoryLine{Query: "second", Answer: "two"})
+	session.checkout(1)
+	session.addTurn("second, again", ChatHistoryLine{Query: "second, again", Answer: "two again"})
+
+	return newChatREPL(newOpenAIProvider(), session, ThymeConfig{ContextStrategy: "drop"}, QueryOptions{})
+}
+
+func TestChatCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		want chatCommandResult
+	}{
+		{"/exit", chatCommandResult{exit: true}},
+		{"/system", chatCommandResult{note: "There is no system prompt"}},
+		{"/system Be brief.", chatCommandResult{note: "System: Be brief."}},
+		{"/file", chatCommandResult{note: "Which file? /file <path>"}},
+		{"/file missing.go", chatCommandResult{note: "There is no file missing.go"}},
+		{"/edit 9", chatCommandResult{note: "Which turn? /edit <1-2> [new question]"}},
+		{"/edit 2", chatCommandResult{note: "Change turn 2 and press Enter, an empty message leaves it as it was", prefill: "second, again"}},
+		{"/branch 3", chatCommandResult{note: "Which branch? /branch <1-2>, /branches lists them"}},
+		{"/nope", chatCommandResult{note: "There is no /nope, /help lists the commands"}},
+	}
+
+	for _, tt := range tests {
+		c := testChatREPL(t)
+
+		if got := c.command(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestChatCommandQuestions(t *testing.T) {
+	c := testChatREPL(t)
+
+	// /retry asks the last question again after the turn before it
+	retry := c.command("/retry").question
+	if retry == nil || retry.parent != 1 || retry.sent != "second, again" || retry.attached {
+		t.Errorf("/retry asks %+v", retry)
+	}
+
+	// /edit asks a new question after the turn before the one edited, with
+	// the files /file attached
+	c.attachments = []string{filepath.Join("testdata", "missing.txt")}
+	if result := c.command("/edit 1 first, again"); result.question != nil || !strings.Contains(result.note, "missing.txt") {
+		t.Errorf("/edit with a missing attachment = %+v", result)
+	}
+
+	c.attachments = nil
+	edit := c.command("/edit 1 first, again").question
+	if edit == nil || edit.parent != 0 || edit.sent != "first, again" || edit.typed != "first, again" || !edit.attached {
+		t.Errorf("/edit asks %+v", edit)
+	}
+
+	// The session is only changed once the question is answered
+	if c.session.turns() != 2 {
+		t.Errorf("the questions changed the chat to %d turns", c.session.turns())
+	}
+}
+
+func TestChatCommandBranches(t *testing.T) {
+	c := testChatREPL(t)
+
+	result := c.command("/branches")
+	if len(result.output) != 2 || !strings.HasPrefix(result.output[1], "* 2: 2 turns, this branch") {
+		t.Errorf("/branches = %q", result.output)
+	}
+
+	result = c.command("/branch 1")
+	if !result.switched || c.session.head() != 2 {
+		t.Errorf("/branch 1 = %+v, on turn %d", result, c.session.head())
+	}
+
+	result = c.command("/undo")
+	if result.note != "Took back the last turn, 1 left" || c.session.head() != 1 {
+		t.Errorf("/undo = %+v, on turn %d", result, c.session.head())
+	}
+
+	result = c.command("/tokens")
+	if len(result.output) != 1 || !strings.HasPrefix(result.output[0], "Turn 1: ") || !strings.Contains(result.note, "llama2") {
+		t.Errorf("/tokens = %+v", result)
+	}
+}
+
+// What a function prints to stdout
+func captureStdout(t *testing.T, print func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	print()
+	w.Close()
+
+	out, _ := io.ReadAll(r)
+	return string(out)
+}
+
+func TestPrintResumedChatQuiet(t *testing.T) {
+	c := testChatREPL(t)
+	c.session.System = "Be brief."
+	c.session.addTurn("code", ChatHistoryLine{Query: "code", Answer: "```go\nfunc main() {}\n```"})
+
+	out := captureStdout(t, func() { printResumedChat(c.session, QueryOptions{Quiet: true}) })
+
+	if strings.Contains(out, "\x1b") {
+		t.Errorf("a quiet chat printed escape codes: %q", out)
+	}
+
+	for _, want := range []string{"Resuming ", "System: Be brief.", "-> code\n---\n```go\nfunc main() {}\n```"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the resumed chat is missing %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+/////////////////
+
+// The kinds of failures a provider call can end in. Each one exits with its
+// own code so scripts calling thyme can tell them apart
+type ErrorKind int
+
+const (
+	ErrorUnknown       ErrorKind = iota
+	ErrorAuth                    // Missing or rejected API key
+	ErrorRateLimit               // Too many requests, or out of quota
+	ErrorContextLength           // The request does not fit in the model's context window
+	ErrorNetwork                 // We never got an answer from the provider
+	ErrorProvider                // The provider answered with an error payload
+	ErrorTimeout                 // The request took longer than the timeout
+)
+
+// Exit codes for each kind of error. 1 is kept for everything else
+var errorExitCodes = map[ErrorKind]int{
+	ErrorUnknown:       1,
+	ErrorAuth:          3,
+	ErrorRateLimit:     4,
+	ErrorContextLength: 5,
+	ErrorNetwork:       6,
+	ErrorProvider:      7,
+	ErrorTimeout:       8,
+}
+
+// Exit code when the user cancels with Ctrl-C, like a shell would use
+const cancelledExitCode = 130
+
+func (k ErrorKind) String() string {
+	switch k {
+	case ErrorAuth:
+		return "authentication error"
+	case ErrorRateLimit:
+		return "rate limited"
+	case ErrorContextLength:
+		return "context length exceeded"
+	case ErrorNetwork:
+		return "network error"
+	case ErrorProvider:
+		return "provider error"
+	case ErrorTimeout:
+		return "timed out"
+	}
+
+	return "error"
+}
+
+/////////////////
+
+// An error from a provider call
+type ProviderError struct {
+	Kind       ErrorKind
+	Provider   string
+	StatusCode int    // HTTP status, 0 if we never got one
+	Message    string // What the provider told us
+	Err        error  // The underlying error, if any
+}
+
+func (e *ProviderError) Error() string {
+	msg := e.Message
+	if msg == "" && e.Err != nil {
+		msg = e.Err.Error()
+	}
+
+	if e.StatusCode > 0 {
+		return fmt.Sprintf("%s: %s (status %d): %s", e.Provider, e.Kind, e.StatusCode, msg)
+	}
+
+	return fmt.Sprintf("%s: %s: %s", e.Provider, e.Kind, msg)
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+/////////////////
+
+// The error kind for an HTTP status code a provider answered with
+func errorKindForStatus(status int) ErrorKind {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrorAuth
+	case status == http.StatusTooManyRequests:
+		return ErrorRateLimit
+	}
+
+	return ErrorProvider
+}
+
+// Wrap an error from the go-openai client into a ProviderError
+func classifyOpenAIError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	// Leave cancellations alone so callers can spot them
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	perr := &ProviderError{Kind: ErrorUnknown, Provider: "openai", Err: err}
+
+	var apiErr *openai.APIError
+	var reqErr *openai.RequestError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &apiErr):
+		perr.StatusCode = apiErr.HTTPStatusCode
+		perr.Message = apiErr.Message
+		perr.Kind = errorKindForStatus(apiErr.HTTPStatusCode)
+
+		if code, ok := apiErr.Code.(string); ok && code == "context_length_exceeded" {
+			perr.Kind = ErrorContextLength
+		}
+
+	case errors.As(err, &reqErr):
+		perr.StatusCode = reqErr.HTTPStatusCode
+		perr.Kind = errorKindForStatus(reqErr.HTTPStatusCode)
+
+	// Check for the deadline first, a timed out request is also a net.Error
+	case errors.Is(err, context.DeadlineExceeded):
+		perr.Kind = ErrorTimeout
+
+	case errors.As(err, &netErr):
+		perr.Kind = ErrorNetwork
+	}
+
+	return perr
+}
+
+/////////////////
+
+// Print a clear message for the error and exit with the code for its kind
+func exitWithError(err error) {
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, "Cancelled")
+		os.Exit(cancelledExitCode)
+	}
+
+	fmt.Fprintln(os.Stderr, describeError(err))
+
+	var perr *ProviderError
+	if errors.As(err, &perr) {
+		os.Exit(errorExitCodes[perr.Kind])
+	}
+
+	os.Exit(errorExitCodes[ErrorUnknown])
+}
+
+// A message telling the user what went wrong and what to do about it
+func describeError(err error) string {
+
+	// Say which step of a chain broke before what went wrong in it
+	var cerr *ChainStepError
+	if errors.As(err, &cerr) {
+		return fmt.Sprintf("Step %d of %d (%s) failed.\n%s", cerr.Step, cerr.Total, cerr.Name, describeError(cerr.Err))
+	}
+
+	var perr *ProviderError
+	if !errors.As(err, &perr) {
+		return err.Error()
+	}
+
+	switch perr.Kind {
+	case ErrorAuth:
+		return fmt.Sprintf("%s rejected the API key, please check your environment variables.\n%s", perr.Provider, perr)
+	case ErrorRateLimit:
+		return fmt.Sprintf("%s is rate limiting us or the quota is used up, please try again later.\n%s", perr.Provider, perr)
+	case ErrorContextLength:
+		return fmt.Sprintf("The request is too long for the model, please shorten it or use a model with a larger context.\n%s", perr)
+	case ErrorNetwork:
+		return fmt.Sprintf("Could not reach %s, please check your connection.\n%s", perr.Provider, perr)
+	case ErrorTimeout:
+		return fmt.Sprintf("%s did not answer in time, raise the limit with -timeout or THYME_TIMEOUT.\n%s", perr.Provider, perr)
+	}
+
+	return perr.Error()
+}
@@ -2,11 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"os"
+	"time"
 )
 
 var (
@@ -28,6 +30,14 @@ type KagiResponse struct {
 		Node string `json:"node"`
 		Ms   int    `json:"ms"`
 	} `json:"meta"`
+
+	Error []KagiError `json:"error"`
+}
+
+// Kagi sends a list of these back instead of data when a request fails
+type KagiError struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
 }
 
 type KagiRequest struct {
@@ -43,19 +53,86 @@ type KagiSource struct {
 	URL     string `json:"url"`
 }
 
-func makeKagiRequest(kagi KagiRequest) KagiResponse {
+/////////////////
+
+var kagiModels = map[string]string{
+	"agnes":  "agnes",
+	"daphne": "daphne",
+	"muriel": "muriel",
+}
+
+// The Kagi Universal Summarizer and FastGPT APIs. FastGPT is used when
+// FastGPT is set, otherwise the summarizer
+type KagiProvider struct {
+	FastGPT bool
+}
+
+func (p *KagiProvider) Name() string {
+	return "kagi"
+}
+
+// We default to agnes, but if the user passes a different one we use that
+func (p *KagiProvider) ResolveModel(alias string) string {
+	if alias == "" {
+		return "agnes"
+	}
+
+	return kagiModels[alias]
+}
+
+// Kagi is not a chat API, so only the last user message is sent
+func (p *KagiProvider) Complete(ctx context.Context, req ProviderRequest) (ProviderResponse, error) {
+	start := time.Now()
+
+	kagi := KagiRequest{
+		Engine:      p.ResolveModel(req.Model),
+		Input:       req.userQuery(),
+		Type:        req.Parameters.InputType,
+		SummaryType: req.Parameters.SummaryType,
+	}
+
+	if p.FastGPT {
+		kagi.Type = "fastgpt"
+		kagi.SummaryType = "fastgpt"
+		kagi.Engine = "fastgpt"
+	}
+
+	response, err := makeKagiRequest(ctx, kagi)
+	if err != nil {
+		return ProviderResponse{}, err
+	}
+
+	references := make([]ProviderReference, 0, len(response.Data.References))
+	for _, source := range response.Data.References {
+		references = append(references, ProviderReference{
+			Title:   source.Title,
+			URL:     source.URL,
+			Snippet: source.Snippet,
+		})
+	}
+
+	return ProviderResponse{
+		Answer:     response.Data.Output,
+		References: references,
+		Model:      kagi.Engine,
+		Usage:      TokenUsage{Total: response.Data.Tokens},
+		Latency:    time.Since(start),
+	}, nil
+}
+
+/////////////////
+
+func makeKagiRequest(ctx context.Context, kagi KagiRequest) (KagiResponse, error) {
 
 	// Sanitize our input to make a JSON string
 	cleanInput, err := json.Marshal(kagi.Input)
 	if err != nil {
-		fmt.Println("Error marshalling input: ", err)
-		os.Exit(1)
+		return KagiResponse{}, fmt.Errorf("marshalling input: %w", err)
 	}
 
 	cleanEngine, err := json.Marshal(kagi.Engine)
 	if err != nil {
-		fmt.Println("Error marshalling engine: ", err)
-		os.Exit(1)
+		return KagiResponse{}, fmt.Errorf("marshalling engine: %w", err)
 	}
 
 	// Set custom headers
@@ -76,8 +153,7 @@ func makeKagiRequest(kagi KagiRequest) KagiResponse {
 
 	cleanSumType, err := json.Marshal(kagi.SummaryType)
 	if err != nil {
-		fmt.Println("Error marshalling sumType: ", err)
-		os.Exit(1)
+		return KagiResponse{}, fmt.Errorf("marshalling sumType: %w", err)
 	}
 
 	// Initialize the request string
@@ -101,9 +177,9 @@ func makeKagiRequest(kagi KagiRequest) KagiResponse {
 		usingEndpoint = kagiURLSummaryEndpoint
 	}
 
-	req, err := http.NewRequest("POST", usingEndpoint, bytes.NewBuffer(brequest))
+	req, err := http.NewRequestWithContext(ctx, "POST", usingEndpoint, bytes.NewBuffer(brequest))
 	if err != nil {
-		fmt.Println(err)
+		return KagiResponse{}, err
 	}
 
 	// Apply the headers to the request
@@ -112,67 +188,45 @@ func makeKagiRequest(kagi KagiRequest) KagiResponse {
 	}
 
 	// Make the HTTP request
-	client := &http.Client{}
+	client := newHTTPClient(loadConfig())
 	resp, err := client.Do(req)
 	if err != nil {
-		fmt.Println(err)
+		if errors.Is(err, context.Canceled) {
+			return KagiResponse{}, err
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			return KagiResponse{}, &ProviderError{Kind: ErrorTimeout, Provider: "kagi", Err: err}
+		}
+
+		return KagiResponse{}, &ProviderError{Kind: ErrorNetwork, Provider: "kagi", Err: err}
 	}
 	defer resp.Body.Close()
 
 	// Convert response body to JSON
 	var response KagiResponse
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		fmt.Println(err)
-	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&response)
 
-	if kagi.Type == "fastgpt" {
-		response.Data.Output += "\n\n" + kagiSourcesToString(response.Data.References)
-	}
+	// Kagi tells us what went wrong in the error list, fall back to the
+	// status code when it did not
+	if resp.StatusCode >= http.StatusBadRequest || len(response.Error) > 0 {
+		perr := &ProviderError{
+			Kind:       errorKindForStatus(resp.StatusCode),
+			Provider:   "kagi",
+			StatusCode: resp.StatusCode,
+			Message:    http.StatusText(resp.StatusCode),
+		}
 
-	if os.Getenv("THYME_QUERY_LOGGING") == "true" {
-		saveKagiSummary(response, kagi)
-	}
-
-	return response
-}
+		if len(response.Error) > 0 {
+			perr.Message = response.Error[0].Msg
+		}
 
-func kagiSourcesToString(sources []KagiSource) string {
-	var output string
-
-	output += "Sources:\n----------\n"
-
-	for a, source := range sources {
-		output += fmt.Sprintf("[%d] %s\n%s\n%s\n\n", a+1, source.Title, source.URL, source.Snippet)
+		return response, perr
 	}
 
-	return output
-}
-
-func saveKagiSummary(response KagiResponse, request KagiRequest) {
-	directory := os.Getenv("THYME_QUERY_KAGI_LOGGING_DIR")
-	fileloc, _, _ := makeSaveNameAndStamps(directory, "summary")
-
-	var q []byte
-	var a []byte
-
-	q, err := json.Marshal(request.Input)
-	if err != nil {
-		q = []byte(request.Input)
-	}
-
-	a, err = json.Marshal(response.Data.Output)
-	if err != nil {
-		a = []byte(response.Data.Output)
-	}
-
-	fileData := fmt.Sprintf(`{"query": %s, "answer": %s}`, string(q), string(a))
-
-	// Write the file
-	err = ioutil.WriteFile(fileloc, []byte(fileData), 0644)
-
-	if err != nil {
-		fmt.Println(err)
+	if decodeErr != nil {
+		return response, &ProviderError{Kind: ErrorProvider, Provider: "kagi", StatusCode: resp.StatusCode, Err: decodeErr}
 	}
 
+	return response, nil
 }
@@ -1,11 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"strings"
 	"time"
@@ -15,279 +17,251 @@ import (
 
 /////////////////
 
-// Call the ChatGPT API with passed string and using a prompt
-func callChatGPT(query string, prompt string, model string) string {
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-
-		// https://platform.openai.com/docs/guides/chat/chat-vs-completions
-
-		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: prompt,
-				},
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: query,
-				},
-			},
-		},
-	)
+// A map of string names to our models
+var openAIModels = map[string]string{
+	"chatgpt":       openai.GPT3Dot5Turbo,
+	"gpt4":          openai.GPT4,
+	"gpt4-32k":      openai.GPT432K,
+	"gpt4-0613":     openai.GPT40613,
+	"gpt4-32k-0613": openai.GPT432K0613,
+}
 
-	if err != nil {
-		fmt.Println(err)
-	}
+// Model names for local OpenAI-compatible servers. These are Ollama's names,
+// llama.cpp's server answers with whatever model it was started with and
+// vLLM expects the Hugging Face name, which can be passed to -model as-is
+var localModels = map[string]string{
+	"llama2":     "llama2",
+	"llama2-13b": "llama2:13b",
+	"llama3":     "llama3",
+	"codellama":  "codellama",
+	"mistral":    "mistral",
+	"mixtral":    "mixtral",
+	"phi":        "phi",
+}
 
-	return resp.Choices[0].Message.Content
+// The OpenAI chat completions API, or a local server that speaks it
+type OpenAIProvider struct {
+	client *openai.Client
+	config ThymeConfig
 }
 
-// Call the ChatGPT API with passed string and using a prompt and passing a JSON schema, no prompt
-func callChatGPTFunctionCall(query string, prompt string, model string, funcCall []byte) string {
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-
-	var FunctionCallObj openai.FunctionCall
-	FunctionCallObj.Name = "functioncall"
-	FunctionCallObj.Arguments = string(funcCall)
-
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-
-		// https://platform.openai.com/docs/guides/chat/chat-vs-completions
-
-		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleSystem,
-					Content: prompt,
-				},
-				{
-					Role:         openai.ChatMessageRoleAssistant,
-					Content:      query,
-					FunctionCall: &FunctionCallObj,
-				},
-			},
-		},
-	)
+func newOpenAIProvider() *OpenAIProvider {
+	return &OpenAIProvider{client: newOpenAIClient(), config: loadConfig()}
+}
 
-	if err != nil {
-		fmt.Println(err)
+// Build the client every OpenAI call goes through. When a base URL is
+// configured we point the client at it, the key can then be empty.
+// Azure gets its own client config that sends requests to deployments
+func newOpenAIClient() *openai.Client {
+	config := loadConfig()
+	clientConfig := openai.DefaultConfig(config.OpenAIKey)
+
+	if config.usingLocalServer() {
+		clientConfig.BaseURL = config.OpenAIBaseURL
+	}
+
+	if config.usingAzure() {
+		clientConfig = openai.DefaultAzureConfig(config.AzureKey, config.AzureEndpoint)
+		clientConfig.APIVersion = config.AzureAPIVersion
+		clientConfig.AzureModelMapperFunc = azureDeploymentMapper(config.AzureDeployments, clientConfig.AzureModelMapperFunc)
 	}
 
-	return resp.Choices[0].Message.Content
+	clientConfig.HTTPClient = newHTTPClient(config)
+
+	return openai.NewClientWithConfig(clientConfig)
 }
 
-/////////////////
+// Azure addresses models by deployment name. The deployments are configured
+// per Thyme alias (chatgpt=my-gpt35), but the client only sees the model the
+// alias resolved to, so look them up by both. Anything not configured falls
+// back to the go-openai default (gpt-3.5-turbo -> gpt-35-turbo)
+func azureDeploymentMapper(deployments map[string]string, fallback func(string) string) func(string) string {
+	byModel := make(map[string]string)
 
-// Call the ChatGPT API with passed string and no prompt
-func callChatGPTNoPrompt(query string, model string) string {
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
-
-		// https://platform.openai.com/docs/guides/chat/chat-vs-completions
-
-		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:    openai.ChatMessageRoleUser,
-					Content: query,
-				},
-			},
-		},
-	)
+	for alias, deployment := range deployments {
+		byModel[alias] = deployment
 
-	if err != nil {
-		fmt.Println(err)
+		if model, ok := openAIModels[alias]; ok {
+			byModel[model] = deployment
+		}
 	}
 
-	return resp.Choices[0].Message.Content
-}
+	return func(model string) string {
+		if deployment, ok := byModel[model]; ok {
+			return deployment
+		}
 
-// Call the ChatGPT API with passed string and using a prompt and passing a JSON schema
-func callChatGPTFunctionCallNoPrompt(query string, prompt string, model string, funcCall []byte) string {
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
+		return fallback(model)
+	}
+}
 
-	var FunctionCallObj openai.FunctionCall
-	FunctionCallObj.Name = "functioncall"
-	FunctionCallObj.Arguments = string(funcCall)
+func (p *OpenAIProvider) Name() string {
+	return "openai"
+}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
+// We default to chatgpt, or the configured local model for a local server.
+// Names we do not know are passed through as-is
+func (p *OpenAIProvider) ResolveModel(alias string) string {
+	if p.config.usingLocalServer() {
+		if alias == "" {
+			alias = p.config.LocalModel
+		}
 
-		// https://platform.openai.com/docs/guides/chat/chat-vs-completions
+		if model, ok := localModels[alias]; ok {
+			return model
+		}
+	}
 
-		openai.ChatCompletionRequest{
-			Model: model,
-			Messages: []openai.ChatCompletionMessage{
-				{
-					Role:         openai.ChatMessageRoleAssistant,
-					Content:      query,
-					FunctionCall: &FunctionCallObj,
-				},
-			},
-		},
-	)
+	if alias == "" {
+		alias = "chatgpt"
+	}
 
-	if err != nil {
-		fmt.Println(err)
+	if model, ok := openAIModels[alias]; ok {
+		return model
 	}
 
-	return resp.Choices[0].Message.Content
+	return alias
 }
 
-/////////////////
+// Call the ChatGPT API with the messages in the request
+func (p *OpenAIProvider) Complete(ctx context.Context, req ProviderRequest) (ProviderResponse, error) {
+	start := time.Now()
 
-// Call the GPT Completions API UNUSED CURRENTLY IT SEEMS
-func callGPT(query string) string {
-	c := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-	ctx := context.Background()
+	// https://platform.openai.com/docs/guides/chat/chat-vs-completions
+	resp, err := p.client.CreateChatCompletion(ctx, p.chatCompletionRequest(req))
 
-	req := openai.CompletionRequest{
-		Model:     openai.GPT3Davinci,
-		MaxTokens: 250,
-		Prompt:    query,
-	}
-	resp, err := c.CreateCompletion(ctx, req)
 	if err != nil {
-		fmt.Println(err)
+		return ProviderResponse{}, classifyOpenAIError(err)
 	}
-	return resp.Choices[0].Text
-}
 
-/////////////////
+	if len(resp.Choices) == 0 {
+		return ProviderResponse{}, &ProviderError{Kind: ErrorProvider, Provider: "openai", Message: "the response had no choices"}
+	}
 
-// Handle a chat interaction with the GPT API
-func gptChat(model string, fileChat bool, proglanguage string, file ...string) {
-	client := openai.NewClient(os.Getenv("OPENAI_API_KEY"))
-	messages := make([]openai.ChatCompletionMessage, 0)
-	reader := bufio.NewReader(os.Stdin)
-	fmt.Println("Conversation")
-	fmt.Println("---------------------")
+	response := ProviderResponse{
+		Answer: resp.Choices[0].Message.Content,
+		Model:  resp.Model,
+		Usage: TokenUsage{
+			Prompt:     resp.Usage.PromptTokens,
+			Completion: resp.Usage.CompletionTokens,
+			Total:      resp.Usage.TotalTokens,
+		},
+		Latency: time.Since(start),
+	}
 
-	// Create the file to save the chats in
-	saveDir := os.Getenv("THYME_QUERY_LOGGING_DIR")
-	savefilename, _, _ := makeSaveNameAndStamps(saveDir, "chat")
+	if call := resp.Choices[0].Message.FunctionCall; call != nil {
+		response.FunctionCall = &ProviderFunctionCall{Name: call.Name, Arguments: call.Arguments}
+	}
 
-	// Make the spinner channel so we can tell when its done
-	spinningComplete := make(chan bool)
+	return response, nil
+}
 
-	chatCount := 0
+// Call the ChatGPT API and stream the answer back as it is generated
+func (p *OpenAIProvider) Stream(ctx context.Context, req ProviderRequest, onToken func(string)) (ProviderResponse, error) {
+	start := time.Now()
 
-	// If we're reading from a file, read it and send it to the API
+	stream, err := p.client.CreateChatCompletionStream(ctx, p.chatCompletionRequest(req))
 
-	for {
+	if err != nil {
+		return ProviderResponse{}, classifyOpenAIError(err)
+	}
 
-		qs := QuerySave{}
-
-		// If we are filechatting
-		if fileChat && chatCount == 0 {
-
-			// Start the spinner
-			go spinner(spinningComplete)
-
-			prompt := "Hello! We would like to ask some questions about this file, please:"
-			text := readFileToString(file[0])
-			text = strings.Replace(text, "\n", "", -1)
-			sendtext := fmt.Sprintf("%s %s", prompt, text)
-			messages = append(messages, openai.ChatCompletionMessage{
-				Role:    openai.ChatMessageRoleUser,
-				Content: sendtext,
-			})
-
-			resp, err := client.CreateChatCompletion(
-				context.Background(),
-				openai.ChatCompletionRequest{
-					Model:    model,
-					Messages: messages,
-				},
-			)
-
-			if err != nil {
-				spinningComplete <- true
-				fmt.Printf("ChatCompletion error: %v\n", err)
-				continue
-			}
+	defer stream.Close()
 
-			// We just save the filename so we dont just create a copy of a
-			// Giant file
-			qs.Query = fmt.Sprintf("%s %s", prompt, file[0])
-			qs.Answer = resp.Choices[0].Message.Content
+	var answer strings.Builder
+	var model string
 
-			saveChat(qs, savefilename)
+	for {
+		chunk, err := stream.Recv()
 
-			chatCount++
-			spinningComplete <- true
-			continue
+		if errors.Is(err, io.EOF) {
+			break
+		}
 
+		if err != nil {
+			// Hand back what we have so far along with the error
+			return ProviderResponse{Answer: answer.String(), Model: model, Latency: time.Since(start)}, classifyOpenAIError(err)
 		}
 
-		prettyPrintChatArrow("-> ")
-		text, _ := reader.ReadString('\n')
-		fmt.Println("---")
-		// convert CRLF to LF
-		text = strings.Replace(text, "\n", "", -1)
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleUser,
-			Content: text,
-		})
-
-		// Start the spinner
-		go spinner(spinningComplete)
-
-		resp, err := client.CreateChatCompletion(
-			context.Background(),
-			openai.ChatCompletionRequest{
-				Model:    model,
-				Messages: messages,
-			},
-		)
+		model = chunk.Model
 
-		if err != nil {
-			spinningComplete <- true
-			fmt.Printf("ChatCompletion error: %v\n", err)
+		if len(chunk.Choices) == 0 {
 			continue
 		}
 
-		content := resp.Choices[0].Message.Content
-		messages = append(messages, openai.ChatCompletionMessage{
-			Role:    openai.ChatMessageRoleAssistant,
-			Content: content,
-		})
+		token := chunk.Choices[0].Delta.Content
+		answer.WriteString(token)
+		onToken(token)
+	}
+
+	return ProviderResponse{
+		Answer:  answer.String(),
+		Model:   model,
+		Latency: time.Since(start),
+	}, nil
+}
 
-		spinningComplete <- true
+// Turn a provider request into the go-openai request type
+func (p *OpenAIProvider) chatCompletionRequest(req ProviderRequest) openai.ChatCompletionRequest {
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.Messages))
+
+	for _, m := range req.Messages {
+		message := openai.ChatCompletionMessage{
+			Role:    m.Role,
+			Content: m.Content,
+			Name:    m.Name,
+		}
+
+		if m.FunctionCall != nil {
+			message.FunctionCall = &openai.FunctionCall{
+				Name:      m.FunctionCall.Name,
+				Arguments: m.FunctionCall.Arguments,
+			}
+		}
 
-		// Save the chat file
-		qs.Query = text
-		qs.Answer = content
-		saveChat(qs, savefilename)
+		messages = append(messages, message)
+	}
 
-		content = formatCodeBlocksInMarkdown(content, proglanguage)
+	chatReq := openai.ChatCompletionRequest{
+		Model:     p.ResolveModel(req.Model),
+		Messages:  messages,
+		MaxTokens: req.Parameters.MaxTokens,
+	}
 
-		typeWriterPrint(content+"\n", false)
+	// go-openai leaves a temperature of 0 out of the request, and the server
+	// then uses its default of 1. The smallest float is sent for 0 instead
+	if temperature := req.Parameters.Temperature; temperature != nil {
+		chatReq.Temperature = *temperature
+		if *temperature == 0 {
+			chatReq.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
 
-		chatCount++
+	// A JSON schema becomes the parameters of the one function the model
+	// can call, and we make it call it
+	if len(req.Parameters.JSONSchema) > 0 {
+		chatReq.Functions = []openai.FunctionDefinition{{
+			Name:        structuredFunctionName,
+			Description: "Give the answer as structured data following the parameters schema",
+			Parameters:  json.RawMessage(req.Parameters.JSONSchema),
+		}}
+		chatReq.FunctionCall = map[string]string{"name": structuredFunctionName}
 	}
+
+	return chatReq
 }
 
 /////////////////
 
-// Save the GPT Completions API response to a file
-// If the THYME_QUERY_LOGGING_DIR environment variable is not set, do nothing
+// Save a query and its answer to a file in saveDir
+// If saveDir is empty (the logging directory is not set), do nothing
 // Timestamp is when it saves, not when you send the query.
-func saveGPT(qs QuerySave) {
-	saveDir := os.Getenv("THYME_QUERY_LOGGING_DIR")
-
+func saveQuery(qs QuerySave, saveDir string, savetype string) {
 	if saveDir == "" {
 		return
 	}
 
-	filename, _, formattingTimeStamp := makeSaveNameAndStamps(saveDir, "query")
+	filename, _, formattingTimeStamp := makeSaveNameAndStamps(saveDir, savetype)
 
 	var t []byte
 	var p []byte
@@ -316,7 +290,7 @@ func saveGPT(qs QuerySave) {
 
 	// Write the file as a json sting string
 	// {'timestampe': '...', 'prompt': '...', 'query': '...', 'answer': ...}
-	// Filename is YYYY-MM-DD-HH-mm-SS-query.json
+	// Filename is YYYY-MM-DD-HH-mm-SS-<savetype>.json
 
 	fileData := fmt.Sprintf(`{"timestamp": %s, "prompt": %s, "query": %s, "answer": %s}`,
 		string(t),
@@ -335,7 +309,7 @@ func saveGPT(qs QuerySave) {
 /////////////////
 
 // Save the chat information, appended to the file
-func saveChat(qs QuerySave, savefile string) {
+func saveChat(line ChatHistoryLine, savefile string) {
 	file, err := os.OpenFile(savefile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		fmt.Println(err.Error())
@@ -344,20 +318,13 @@ func saveChat(qs QuerySave, savefile string) {
 
 	defer file.Close()
 
-	var q []byte
-	var a []byte
-
-	q, err = json.Marshal(qs.Query)
+	data, err := json.Marshal(line)
 	if err != nil {
-		q = []byte(qs.Query)
-	}
-
-	a, err = json.Marshal(qs.Answer)
-	if err != nil {
-		a = []byte(qs.Answer)
+		fmt.Println(err.Error())
+		return
 	}
 
-	savestr := fmt.Sprintf(`{"query": %s, "answer": %s}`, q, a) + "\n"
+	savestr := string(data) + "\n"
 
 	if _, err := file.WriteString(savestr); err != nil { // Append text to file
 		fmt.Println(err.Error())
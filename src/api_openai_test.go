@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A stand-in for the OpenAI, Azure OpenAI or local server chat endpoint. It
+// records the last request and answers with a completion, streamed or not
+type fakeChatServer struct {
+	*httptest.Server
+	path    string
+	query   string
+	headers http.Header
+	body    map[string]interface{}
+}
+
+func newFakeChatServer(t *testing.T, answer string) *fakeChatServer {
+	s := &fakeChatServer{}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.path, s.query, s.headers = r.URL.Path, r.URL.RawQuery, r.Header.Clone()
+
+		data, _ := io.ReadAll(r.Body)
+		s.body = map[string]interface{}{}
+		if err := json.Unmarshal(data, &s.body); err != nil {
+			t.Errorf("the request body is not JSON: %s", data)
+		}
+
+		if s.body["stream"] == true {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, token := range strings.SplitAfter(answer, " ") {
+				chunk, _ := json.Marshal(map[string]interface{}{
+					"model":   s.body["model"],
+					"choices": []map[string]interface{}{{"index": 0, "delta": map[string]string{"content": token}}},
+				})
+				fmt.Fprintf(w, "data: %s\n\n", chunk)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+			return
+		}
+
+		message := map[string]interface{}{"role": "assistant", "content": answer}
+		if _, ok := s.body["function_call"]; ok {
+			message = map[string]interface{}{
+				"role":          "assistant",
+				"function_call": map[string]string{"name": structuredFunctionName, "arguments": answer},
+			}
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"model":   s.body["model"],
+			"choices": []map[string]interface{}{{"index": 0, "message": message}},
+			"usage":   map[string]int{"prompt_tokens": 5, "completion_tokens": 3, "total_tokens": 8},
+		})
+	}))
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// Point the OpenAI provider at the stand-in, the way the environment would
+func setProviderEnv(t *testing.T, env map[string]string) {
+	for _, name := range []string{"OPENAI_API_KEY", "THYME_OPENAI_BASE_URL", "THYME_LOCAL_MODEL", "THYME_AZURE_ENDPOINT", "THYME_AZURE_API_KEY", "THYME_AZURE_API_VERSION", "THYME_AZURE_DEPLOYMENTS"} {
+		t.Setenv(name, env[name])
+	}
+
+	t.Setenv("THYME_RETRY_MAX_ATTEMPTS", "1")
+}
+
+func TestOpenAIProviderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    func(url string) map[string]string
+		model  string
+		path   string
+		query  string
+		header string
+		value  string
+		sentAs string
+	}{
+		{
+			name:   "local server",
+			env:    func(url string) map[string]string { return map[string]string{"THYME_OPENAI_BASE_URL": url + "/v1"} },
+			model:  "",
+			path:   "/v1/chat/completions",
+			sentAs: "llama2",
+		},
+		{
+			name: "local server with a key",
+			env: func(url string) map[string]string {
+				return map[string]string{"THYME_OPENAI_BASE_URL": url, "OPENAI_API_KEY": "sk-test"}
+			},
+			model:  "gpt-4",
+			path:   "/chat/completions",
+			header: "Authorization",
+			value:  "Bearer sk-test",
+			sentAs: "gpt-4",
+		},
+		{
+			name: "azure deployment by alias",
+			env: func(url string) map[string]string {
+				return map[string]string{
+					"THYME_AZURE_ENDPOINT":    url,
+					"THYME_AZURE_API_KEY":     "azure-key",
+					"THYME_AZURE_API_VERSION": "2023-07-01-preview",
+					"THYME_AZURE_DEPLOYMENTS": "chatgpt=team-gpt35, gpt4=team-gpt4",
+				}
+			},
+			model:  "gpt4",
+			path:   "/openai/deployments/team-gpt4/chat/completions",
+			query:  "api-version=2023-07-01-preview",
+			header: "Api-Key",
+			value:  "azure-key",
+			sentAs: "gpt-4",
+		},
+		{
+			name: "azure default deployment",
+			env: func(url string) map[string]string {
+				return map[string]string{"THYME_AZURE_ENDPOINT": url, "THYME_AZURE_API_KEY": "azure-key"}
+			},
+			model:  "chatgpt",
+			path:   "/openai/deployments/gpt-35-turbo/chat/completions",
+			query:  "api-version=2023-05-15",
+			header: "Api-Key",
+			value:  "azure-key",
+			sentAs: "gpt-3.5-turbo",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, streaming := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s streaming=%v", tt.name, streaming), func(t *testing.T) {
+				server := newFakeChatServer(t, "hello from the stand-in")
+
+				env := tt.env(server.URL)
+				setProviderEnv(t, env)
+
+				provider := newOpenAIProvider()
+
+				req := ProviderRequest{
+					Model:    provider.ResolveModel(tt.model),
+					Messages: buildPromptMessages("Be brief.", nil, "Say hello"),
+				}
+
+				var resp ProviderResponse
+				var err error
+				tokens := []string{}
+
+				if streaming {
+					resp, err = provider.Stream(context.Background(), req, func(token string) {
+						tokens = append(tokens, token)
+					})
+				} else {
+					resp, err = provider.Complete(context.Background(), req)
+				}
+
+				if err != nil {
+					t.Fatalf("the request failed: %v", err)
+				}
+
+				if resp.Answer != "hello from the stand-in" {
+					t.Errorf("answer = %q", resp.Answer)
+				}
+
+				if streaming && len(tokens) != 4 {
+					t.Errorf("got %d tokens, want 4: %q", len(tokens), tokens)
+				}
+
+				if server.path != tt.path {
+					t.Errorf("path = %s, want %s", server.path, tt.path)
+				}
+
+				if server.query != tt.query {
+					t.Errorf("query = %s, want %s", server.query, tt.query)
+				}
+
+				if tt.header != "" && server.headers.Get(tt.header) != tt.value {
+					t.Errorf("%s header = %q, want %q", tt.header, server.headers.Get(tt.header), tt.value)
+				}
+
+				if server.body["model"] != tt.sentAs {
+					t.Errorf("model = %v, want %s", server.body["model"], tt.sentAs)
+				}
+
+				messages, _ := server.body["messages"].([]interface{})
+				if len(messages) != 2 {
+					t.Fatalf("sent %d messages, want the system prompt and the question", len(messages))
+				}
+
+				if first := messages[0].(map[string]interface{}); first["role"] != "system" || first["content"] != "Be brief." {
+					t.Errorf("first message = %v", first)
+				}
+			})
+		}
+	}
+}
+
+func TestOpenAIProviderFunctionCall(t *testing.T) {
+	server := newFakeChatServer(t, `{"name":"thyme"}`)
+	setProviderEnv(t, map[string]string{"THYME_OPENAI_BASE_URL": server.URL})
+
+	provider := newOpenAIProvider()
+
+	req := ProviderRequest{
+		Model:      provider.ResolveModel(""),
+		Messages:   buildPromptMessages("", nil, "Name this tool"),
+		Parameters: ProviderParameters{JSONSchema: []byte(`{"type":"object","properties":{"name":{"type":"string"}}}`)},
+	}
+
+	resp, err := provider.Complete(context.Background(), req)
+	if err != nil {
+		t.Fatalf("the request failed: %v", err)
+	}
+
+	if resp.FunctionCall == nil || resp.FunctionCall.Arguments != `{"name":"thyme"}` {
+		t.Fatalf("function call = %+v", resp.FunctionCall)
+	}
+
+	call, _ := server.body["function_call"].(map[string]interface{})
+	if call["name"] != structuredFunctionName {
+		t.Errorf("function_call = %v, want %s to be forced", server.body["function_call"], structuredFunctionName)
+	}
+}
+
+func TestOpenAIProviderErrors(t *testing.T) {
+	tests := []struct {
+		status int
+		kind   ErrorKind
+	}{
+		{http.StatusUnauthorized, ErrorAuth},
+		{http.StatusTooManyRequests, ErrorRateLimit},
+		{http.StatusInternalServerError, ErrorProvider},
+	}
+
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, `{"error":{"message":"no","type":"test"}}`)
+			}))
+			defer server.Close()
+
+			setProviderEnv(t, map[string]string{"THYME_OPENAI_BASE_URL": server.URL})
+
+			_, err := newOpenAIProvider().Complete(context.Background(), ProviderRequest{Messages: buildPromptMessages("", nil, "hi")})
+
+			perr, ok := err.(*ProviderError)
+			if !ok {
+				t.Fatalf("err = %v, want a *ProviderError", err)
+			}
+
+			if perr.Kind != tt.kind {
+				t.Errorf("kind = %v, want %v", perr.Kind, tt.kind)
+			}
+		})
+	}
+}
+
+func TestOpenAITemperature(t *testing.T) {
+	zero, warm := float32(0), float32(0.7)
+
+	tests := []struct {
+		name        string
+		temperature *float32
+		sent        bool
+	}{
+		{"left to the server", nil, false},
+		{"zero", &zero, true},
+		{"set", &warm, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeChatServer(t, "hello")
+			setProviderEnv(t, map[string]string{"THYME_OPENAI_BASE_URL": server.URL})
+
+			req := ProviderRequest{
+				Messages:   buildPromptMessages("", nil, "Say hello"),
+				Parameters: ProviderParameters{Temperature: tt.temperature},
+			}
+
+			if _, err := newOpenAIProvider().Complete(context.Background(), req); err != nil {
+				t.Fatalf("the request failed: %v", err)
+			}
+
+			sent, ok := server.body["temperature"].(float64)
+			if ok != tt.sent {
+				t.Fatalf("temperature sent = %v, want it sent: %v", server.body["temperature"], tt.sent)
+			}
+
+			// 0 goes out as the smallest float, which the server takes as 0
+			if tt.sent && math.Abs(sent-float64(*tt.temperature)) > 1e-6 {
+				t.Errorf("temperature = %v, want %v", sent, *tt.temperature)
+			}
+		})
+	}
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/////////////////
+
+// A file of prompt tests, in YAML, JSON or TOML. The cases run the file's
+// prompt unless they name their own
+type PromptTestFile struct {
+	Prompt string           `json:"prompt" yaml:"prompt" toml:"prompt"`
+	Cases  []PromptTestCase `json:"cases" yaml:"cases" toml:"cases"`
+}
+
+// One input to run a prompt on, and what the answer has to look like
+type PromptTestCase struct {
+	Name      string            `json:"name" yaml:"name" toml:"name"`
+	Prompt    string            `json:"prompt" yaml:"prompt" toml:"prompt"`
+	Input     string            `json:"input" yaml:"input" toml:"input"`
+	InputFile string            `json:"input_file" yaml:"input_file" toml:"input_file"` // Relative to the test file
+	Vars      map[string]string `json:"vars" yaml:"vars" toml:"vars"`
+	Assert    PromptAssertions  `json:"assert" yaml:"assert" toml:"assert"`
+}
+
+// What is checked on an answer. Every assertion that is set has to hold
+type PromptAssertions struct {
+	Contains   []string `json:"contains" yaml:"contains" toml:"contains"`
+	Regex      []string `json:"regex" yaml:"regex" toml:"regex"`
+	JSONSchema string   `json:"json_schema" yaml:"json_schema" toml:"json_schema"` // Schema file, relative to the test file
+	MaxLength  int      `json:"max_length" yaml:"max_length" toml:"max_length"`    // In characters
+}
+
+// A recorded answer. They are kept next to the test file, so the tests can
+// run again without a provider
+type PromptRecording struct {
+	Prompt string `json:"prompt"`
+	Input  string `json:"input"`
+	Answer string `json:"answer"`
+}
+
+// The file name suffix recordings are saved with
+const promptRecordingSuffix = ".recordings.json"
+
+// What {{.Date}} is in prompt tests. The rendered prompt is part of the
+// recording key, so a real date would stop recordings matching the next day
+const promptTestDate = "2023-01-01"
+
+// Files without cases, such as schemas next to the tests, are skipped when
+// a whole directory is run
+var errNoPromptTestCases = errors.New("the file has no cases")
+
+/////////////////
+
+// Stands in for a provider in prompt tests. When replaying, answers come from
+// the recordings and nothing is sent. When recording, requests go to the
+// real provider and its answers are recorded. Either way the requests are
+// built for the provider it stands in for
+type recordedProvider struct {
+	provider   Provider // Only sent to when recording
+	replay     bool
+	name       string
+	recordings map[string]PromptRecording
+}
+
+func (p *recordedProvider) Name() string {
+	return p.name
+}
+
+func (p *recordedProvider) ResolveModel(alias string) string {
+	if p.replay {
+		return alias
+	}
+
+	return p.provider.ResolveModel(alias)
+}
+
+func (p *recordedProvider) Complete(ctx context.Context, req ProviderRequest) (ProviderResponse, error) {
+	key := recordingKey(p.name, req)
+
+	if p.replay {
+		recording, ok := p.recordings[key]
+		if !ok {
+			return ProviderResponse{}, errors.New("there is no recorded answer for this request, run the tests with -record first")
+		}
+
+		return ProviderResponse{Answer: recording.Answer, Model: req.Model}, nil
+	}
+
+	resp, err := p.provider.Complete(ctx, req)
+	if err == nil {
+		p.recordings[key] = PromptRecording{
+			Prompt: req.systemPrompt(),
+			Input:  req.userQuery(),
+			Answer: resp.Answer,
+		}
+	}
+
+	return resp, err
+}
+
+// Recordings are looked up by everything that changes the answer: the
+// provider, the model, the sampling settings and the messages
+func recordingKey(provider string, req ProviderRequest) string {
+	// A temperature of 0 is marked apart from one left to the provider. The
+	// mark is left out otherwise, so recordings keep the keys they had
+	temperature, zero := float32(0), false
+	if req.Parameters.Temperature != nil {
+		temperature, zero = *req.Parameters.Temperature, *req.Parameters.Temperature == 0
+	}
+
+	data, _ := json.Marshal(struct {
+		Provider        string
+		Model           string
+		Temperature     float32
+		ZeroTemperature bool `json:",omitempty"`
+		MaxTokens       int
+		Messages        []ProviderMessage
+	}{provider, req.Model, temperature, zero, req.Parameters.MaxTokens, req.Messages})
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+/////////////////
+
+// How the prompt tests talk to the providers
+type promptTestRun struct {
+	prompts map[string]Prompt
+	config  ThymeConfig
+	model   string // From -model, wins over the prompts' own
+	record  bool
+	replay  bool
+	timeout time.Duration
+}
+
+// thyme prompt test [flags] [test files or directories]. Runs every case,
+// prints a report and returns the exit code: 0 when everything passed
+func runPromptTests(args []string) int {
+	flags := flag.NewFlagSet("thyme prompt test", flag.ExitOnError)
+	modelFlag := flags.String("model", "", "The model to test the prompts with, instead of their own or the default.")
+	recordFlag := flags.Bool("record", false, "Run against the provider and record the answers next to the test files.")
+	replayFlag := flags.Bool("replay", false, "Answer from the recorded answers. Nothing is sent to a provider.")
+	timeoutFlag := flags.Duration("timeout", 0, "How long to wait for each answer, e.g. 30s or 2m. Defaults to THYME_TIMEOUT or 5m.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: thyme prompt test [flags] [test files or directories]\n\nWithout files, the tests directory next to every prompts directory is used.\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *recordFlag && *replayFlag {
+		fmt.Fprintln(os.Stderr, "You cannot use both -record and -replay. Please use one or the other.")
+		return 1
+	}
+
+	run := promptTestRun{
+		prompts: initPrompts(),
+		config:  loadConfig(),
+		model:   *modelFlag,
+		record:  *recordFlag,
+		replay:  *replayFlag,
+	}
+
+	run.timeout = run.config.Timeout
+	if *timeoutFlag > 0 {
+		run.timeout = *timeoutFlag
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = promptTestDirs()
+	}
+
+	named := map[string]bool{}
+	for _, path := range paths {
+		named[path] = true
+	}
+
+	files := findPromptTestFiles(paths)
+	if len(files) == 0 {
+		fmt.Fprintf(os.Stderr, "No prompt tests found in %s\n", strings.Join(paths, ", "))
+		return 1
+	}
+
+	styles := getFontStyles()
+	passed, failed := 0, 0
+
+	for _, file := range files {
+		p, f, err := run.runFile(file, styles)
+		passed += p
+		failed += f
+
+		if errors.Is(err, context.Canceled) {
+			fmt.Println("Cancelled")
+			return cancelledExitCode
+		}
+
+		if errors.Is(err, errNoPromptTestCases) && !named[file] {
+			continue
+		}
+
+		if err != nil {
+			fmt.Printf("%s %s: %s\n", styles.testFail.Render("ERROR"), file, err)
+			failed++
+		}
+	}
+
+	fmt.Printf("\n%d passed, %d failed\n", passed, failed)
+
+	if failed > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// Run the cases in one test file and print how each went
+func (run promptTestRun) runFile(path string, styles FontStyle) (int, int, error) {
+	file, err := loadPromptTestFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	recordingsPath := strings.TrimSuffix(path, filepath.Ext(path)) + promptRecordingSuffix
+	recordings := map[string]PromptRecording{}
+
+	if run.record || run.replay {
+		if data, err := os.ReadFile(recordingsPath); err == nil {
+			if err := json.Unmarshal(data, &recordings); err != nil {
+				return 0, 0, fmt.Errorf("reading %s: %w", recordingsPath, err)
+			}
+		}
+	}
+
+	fmt.Printf("\n%s\n", styles.historyTitle.Render(path))
+
+	passed, failed := 0, 0
+
+	for i, tc := range file.Cases {
+		if tc.Prompt == "" {
+			tc.Prompt = file.Prompt
+		}
+
+		if tc.Name == "" {
+			tc.Name = fmt.Sprintf("case %d", i+1)
+		}
+
+		start := time.Now()
+		answer, problems, err := run.runCase(tc, filepath.Dir(path), recordings)
+
+		if errors.Is(err, context.Canceled) {
+			return passed, failed, err
+		}
+
+		if err != nil {
+			problems = append(problems, describeError(err))
+		}
+
+		if len(problems) == 0 {
+			passed++
+			fmt.Printf("  %s %s: %s (%s)\n", styles.testPass.Render("PASS"), tc.Prompt, tc.Name, time.Since(start).Round(time.Millisecond))
+			continue
+		}
+
+		failed++
+		fmt.Printf("  %s %s: %s\n", styles.testFail.Render("FAIL"), tc.Prompt, tc.Name)
+
+		for _, problem := range problems {
+			fmt.Printf("      - %s\n", strings.ReplaceAll(problem, "\n", "\n        "))
+		}
+
+		if answer != "" {
+			fmt.Printf("      answer: %s\n", truncateForReport(answer, 200))
+		}
+	}
+
+	if run.record {
+		data, err := json.MarshalIndent(recordings, "", "  ")
+		if err == nil {
+			err = os.WriteFile(recordingsPath, data, 0644)
+		}
+
+		if err != nil {
+			return passed, failed, fmt.Errorf("saving the recordings: %w", err)
+		}
+	}
+
+	return passed, failed, nil
+}
+
+// Run one case. Returns the answer and the assertions it broke. An error
+// means we never got an answer to check
+func (run promptTestRun) runCase(tc PromptTestCase, dir string, recordings map[string]PromptRecording) (string, []string, error) {
+	prompt, ok := run.prompts[tc.Prompt]
+	if !ok {
+		return "", nil, fmt.Errorf("there is no prompt called %s, see thyme -l for the list", tc.Prompt)
+	}
+
+	if prompt.isChain() {
+		return "", nil, fmt.Errorf("%s is a chain, only single prompts can be tested", tc.Prompt)
+	}
+
+	input := tc.Input
+	filename := ""
+
+	if tc.InputFile != "" {
+		filename = filepath.Join(dir, tc.InputFile)
+
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return "", nil, err
+		}
+
+		input = string(data)
+	}
+
+	// Keep the rendered prompt the same wherever and whenever the tests run:
+	// the input file as the test names it, and a fixed date. The case's own
+	// vars still win
+	vars := promptTemplateVars(tc.InputFile, input, prompt.Defaults.Language, nil)
+	vars["Date"] = promptTestDate
+
+	for key, value := range tc.Vars {
+		vars[key] = value
+	}
+
+	rendered, err := prompt.render(vars)
+	if err != nil {
+		return "", nil, err
+	}
+
+	provider, err := run.provider(prompt.Defaults.Provider, recordings)
+	if err != nil {
+		return "", nil, err
+	}
+
+	req := promptRequest(provider, rendered, input)
+	if run.model != "" {
+		req.Model = run.model
+	}
+
+	// Ask for JSON the same way a normal run would, so the tests see what users see
+	if prompt.Defaults.Format == "json" {
+		req.Messages = withSystemInstruction(req.Messages, jsonFormatInstruction)
+	}
+
+	ctx, cancel := newRequestContext(run.timeout)
+	defer cancel()
+
+	resp, err := provider.Complete(ctx, req)
+	if err != nil {
+		return "", nil, err
+	}
+
+	answer := removeLeadingNewLines(resp.Answer)
+
+	return answer, checkPromptAssertions(answer, tc.Assert, dir), nil
+}
+
+// The provider a prompt runs on, or the stand-in when recording or replaying
+func (run promptTestRun) provider(name string, recordings map[string]PromptRecording) (Provider, error) {
+	if name == "" {
+		name = "openai"
+	}
+
+	// Replays send nothing, so they need no credentials
+	if run.replay {
+		provider, err := providerByName(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return &recordedProvider{provider: provider, replay: true, name: name, recordings: recordings}, nil
+	}
+
+	provider, err := newProviderByName(name, run.config)
+	if err != nil {
+		return nil, err
+	}
+
+	if run.record {
+		return &recordedProvider{provider: provider, name: name, recordings: recordings}, nil
+	}
+
+	return provider, nil
+}
+
+/////////////////
+
+// Check an answer against the assertions. Returns what does not hold
+func checkPromptAssertions(answer string, assert PromptAssertions, dir string) []string {
+	problems := []string{}
+
+	for _, text := range assert.Contains {
+		if !strings.Contains(answer, text) {
+			problems = append(problems, fmt.Sprintf("does not contain %q", text))
+		}
+	}
+
+	for _, pattern := range assert.Regex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("bad regex %q: %s", pattern, err))
+			continue
+		}
+
+		if !re.MatchString(answer) {
+			problems = append(problems, fmt.Sprintf("does not match %q", pattern))
+		}
+	}
+
+	if assert.MaxLength > 0 {
+		if length := len([]rune(answer)); length > assert.MaxLength {
+			problems = append(problems, fmt.Sprintf("is %d characters long, the most is %d", length, assert.MaxLength))
+		}
+	}
+
+	if assert.JSONSchema != "" {
+		problems = append(problems, checkAnswerJSONSchema(answer, filepath.Join(dir, assert.JSONSchema))...)
+	}
+
+	return problems
+}
+
+// Check that the answer is JSON that follows the schema in a file. Answers
+// wrapped in a code block are unwrapped first
+func checkAnswerJSONSchema(answer string, schemaPath string) []string {
+	data, err := os.ReadFile(schemaPath)
+	if err != nil {
+		return []string{fmt.Sprintf("reading the schema: %s", err)}
+	}
+
+	schema, err := parseJSONSchema(data)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	document := strings.TrimSpace(answer)
+	if blocks := extractCodeBlocks(document); len(blocks) > 0 {
+		document = blocks[0]
+	}
+
+	problems := validateJSONAgainstSchema([]byte(document), schema)
+	for i := range problems {
+		problems[i] = "json schema: " + problems[i]
+	}
+
+	return problems
+}
+
+// Shorten an answer to one line for the report
+func truncateForReport(s string, max int) string {
+	s = strings.Join(strings.Fields(s), " ")
+
+	if runes := []rune(s); len(runes) > max {
+		return string(runes[:max]) + "..."
+	}
+
+	return s
+}
+
+/////////////////
+
+// Where the tests live when no files are given: a tests directory in every
+// prompts directory
+func promptTestDirs() []string {
+	dirs := []string{}
+
+	for _, dir := range promptDirs() {
+		dirs = append(dirs, filepath.Join(dir, "tests"))
+	}
+
+	return dirs
+}
+
+// The test files in the given files and directories, directories in
+// filename order. Recordings are skipped
+func findPromptTestFiles(paths []string) []string {
+	files := []string{}
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Could not read %s: %s\n", path, err)
+			}
+
+			continue
+		}
+
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not read %s: %s\n", path, err)
+			continue
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || !isPromptFile(name) || strings.HasSuffix(name, promptRecordingSuffix) {
+				continue
+			}
+
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+
+	return files
+}
+
+// Load a test file, in the same formats as prompt files
+func loadPromptTestFile(path string) (PromptTestFile, error) {
+	var file PromptTestFile
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return file, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &file)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	case ".toml":
+		err = toml.Unmarshal(data, &file)
+	default:
+		err = fmt.Errorf("unknown test file type %s, use .yaml, .json or .toml", filepath.Ext(path))
+	}
+
+	if err != nil {
+		return file, err
+	}
+
+	if len(file.Cases) == 0 {
+		return file, errNoPromptTestCases
+	}
+
+	return file, nil
+}
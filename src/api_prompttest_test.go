@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPromptTestRecordingsStayPut(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("We need coffee"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := promptTestRun{
+		prompts: map[string]Prompt{"dated": {Name: "dated", Text: "On {{.Date}}, list the actions in {{.Filename}}"}},
+		replay:  true,
+	}
+
+	tests := []struct {
+		name   string
+		vars   map[string]string
+		prompt string // What the recording was made with
+	}{
+		{"fixed date", nil, "On 2023-01-01, list the actions in notes.txt"},
+		{"the case sets the date", map[string]string{"Date": "2024-02-29"}, "On 2024-02-29, list the actions in notes.txt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorded := ProviderRequest{Messages: buildPromptMessages(tt.prompt, nil, "We need coffee")}
+			recordings := map[string]PromptRecording{
+				recordingKey("openai", recorded): {Answer: "1. Buy coffee"},
+			}
+
+			tc := PromptTestCase{Name: tt.name, Prompt: "dated", InputFile: "notes.txt", Vars: tt.vars}
+
+			answer, _, err := run.runCase(tc, dir, recordings)
+			if err != nil {
+				t.Fatalf("the recording was not found: %v", err)
+			}
+
+			if answer != "1. Buy coffee" {
+				t.Errorf("answer = %q", answer)
+			}
+		})
+	}
+}
+
+func TestRecordingKey(t *testing.T) {
+	base := ProviderRequest{Model: "gpt-4", Messages: buildPromptMessages("Be brief", nil, "hi")}
+
+	one, zero := float32(1), float32(0)
+
+	changed := []ProviderRequest{
+		{Model: "gpt-3.5-turbo", Messages: base.Messages},
+		{Model: "gpt-4", Messages: buildPromptMessages("Be long", nil, "hi")},
+		{Model: "gpt-4", Messages: base.Messages, Parameters: ProviderParameters{Temperature: &one}},
+		{Model: "gpt-4", Messages: base.Messages, Parameters: ProviderParameters{Temperature: &zero}},
+	}
+
+	if recordingKey("openai", base) != recordingKey("openai", base) {
+		t.Fatal("the same request gave two keys")
+	}
+
+	if recordingKey("openai", base) == recordingKey("kagi", base) {
+		t.Error("the provider does not change the key")
+	}
+
+	for i, req := range changed {
+		if recordingKey("openai", req) == recordingKey("openai", base) {
+			t.Errorf("change %d did not change the key", i+1)
+		}
+	}
+}
+
+func TestPromptTestKagiRecordings(t *testing.T) {
+	tests := []struct {
+		provider string
+		input    string // What the provider is sent
+	}{
+		{"kagi", "We need coffee"},
+		{"fastgpt", "List the actions\n\nWe need coffee"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			prompt := Prompt{Name: "actions", Text: "List the actions", Defaults: PromptDefaults{Provider: tt.provider}}
+
+			// Recording builds the request of the provider it stands in for
+			recorder := &recordedProvider{provider: &KagiProvider{FastGPT: tt.provider == "fastgpt"}, name: tt.provider}
+
+			req := promptRequest(recorder, prompt, "We need coffee")
+			if req.Parameters.InputType != "text" || req.userQuery() != tt.input || req.systemPrompt() != "" {
+				t.Fatalf("recorded request = %+v, want %q sent as text", req, tt.input)
+			}
+
+			// And the replay finds what was recorded
+			run := promptTestRun{prompts: map[string]Prompt{"actions": prompt}, replay: true}
+			recordings := map[string]PromptRecording{
+				recordingKey(tt.provider, req): {Answer: "1. Buy coffee"},
+			}
+
+			answer, _, err := run.runCase(PromptTestCase{Name: "kagi", Prompt: "actions", Input: "We need coffee"}, t.TempDir(), recordings)
+			if err != nil {
+				t.Fatalf("the recording was not found: %v", err)
+			}
+
+			if answer != "1. Buy coffee" {
+				t.Errorf("answer = %q", answer)
+			}
+		})
+	}
+}
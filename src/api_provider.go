@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+/////////////////
+
+// A single message in a conversation with a provider. Roles follow the OpenAI
+// naming: system, user, assistant
+type ProviderMessage struct {
+	Role    string
+	Content string
+
+	Name         string                // For function messages, the function that was called
+	FunctionCall *ProviderFunctionCall // For assistant messages that called a function
+}
+
+// A function the model chose to call, with its arguments as a JSON string
+type ProviderFunctionCall struct {
+	Name      string
+	Arguments string
+}
+
+// Tunables for a request. Providers ignore whatever does not apply to them
+type ProviderParameters struct {
+	Temperature *float32 // nil leaves it to the provider
+	MaxTokens   int
+	JSONSchema  []byte // OpenAI: schema the answer must follow, sent as a function the model has to call
+	InputType   string // Kagi: url or text
+	SummaryType string // Kagi: summary or notes
+}
+
+// The common request every provider accepts
+type ProviderRequest struct {
+	Messages   []ProviderMessage
+	Model      string // Thyme alias or raw model name. Empty for the provider default
+	Parameters ProviderParameters
+}
+
+// A source the provider used to build its answer (Kagi FastGPT)
+type ProviderReference struct {
+	Title   string
+	URL     string
+	Snippet string
+}
+
+type TokenUsage struct {
+	Prompt     int
+	Completion int
+	Total      int
+}
+
+// The common response every provider returns
+type ProviderResponse struct {
+	Answer       string
+	FunctionCall *ProviderFunctionCall // Set when the model answered by calling a function
+	References   []ProviderReference
+	Model        string
+	Usage        TokenUsage
+	Latency      time.Duration
+}
+
+// Every backend Thyme can talk to implements this
+type Provider interface {
+	// Short name of the provider, also used to pick the history directory
+	Name() string
+
+	// Turn a Thyme model alias (chatgpt, agnes, ...) into the provider's model name
+	ResolveModel(alias string) string
+
+	// Send the request and wait for the full answer
+	Complete(ctx context.Context, req ProviderRequest) (ProviderResponse, error)
+}
+
+// Providers that can send the answer back token by token
+type StreamingProvider interface {
+	Provider
+
+	// Send the request, calling onToken for every piece of the answer as it
+	// arrives. The returned response holds the full answer
+	Stream(ctx context.Context, req ProviderRequest, onToken func(string)) (ProviderResponse, error)
+}
+
+/////////////////
+
+// Options for how a one-shot query is displayed and saved
+type QueryOptions struct {
+	Quiet       bool   // No spinner, typewriter or colors
+	Language    string // Language for code block highlighting. Empty to guess
+	SaveQueries bool   // Save the query and answer to the history directory
+	Format      string // How to print the answer: plain, json or code. Empty is plain
+
+	Timeout time.Duration // How long a request may take. 0 for no limit
+}
+
+// Return the content of the first system message in the request
+func (req ProviderRequest) systemPrompt() string {
+	for _, m := range req.Messages {
+		if m.Role == "system" {
+			return m.Content
+		}
+	}
+
+	return ""
+}
+
+// Return the content of the last user message in the request
+func (req ProviderRequest) userQuery() string {
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == "user" {
+			return req.Messages[i].Content
+		}
+	}
+
+	return ""
+}
+
+/////////////////
+
+// Build the messages for a prompt and a query, with the prompt's example
+// exchanges in between. The system message is left out when there is no prompt
+func buildPromptMessages(prompt string, examples []ProviderMessage, query string) []ProviderMessage {
+	messages := make([]ProviderMessage, 0, len(examples)+2)
+
+	if prompt != "" {
+		messages = append(messages, ProviderMessage{Role: "system", Content: prompt})
+	}
+
+	messages = append(messages, examples...)
+	messages = append(messages, ProviderMessage{Role: "user", Content: query})
+
+	return messages
+}
+
+/////////////////
+
+// Run a one-shot query against any provider. Handles the spinner, saving the
+// history and printing the answer so every backend behaves the same
+func runProviderQuery(provider Provider, req ProviderRequest, opts QueryOptions) error {
+
+	// Structured (JSON schema) answers are only useful once they are
+	// complete and validated
+	if len(req.Parameters.JSONSchema) > 0 {
+		return runStructuredQuery(provider, req, opts)
+	}
+
+	// JSON and code answers are only printed once they are complete
+	if opts.Format == "json" {
+		req.Messages = withSystemInstruction(req.Messages, jsonFormatInstruction)
+	}
+
+	// Stream the answer when we can
+	if sp, ok := provider.(StreamingProvider); ok && !opts.wholeAnswer() {
+		return streamProviderQuery(sp, req, opts)
+	}
+
+	resp, err := completeWithSpinner(provider, req, opts)
+	if err != nil {
+		return err
+	}
+
+	answer := removeLeadingNewLines(resp.Answer)
+
+	if len(resp.References) > 0 {
+		answer += "\n\n" + referencesToString(resp.References)
+	}
+
+	// Save query before we display it incase user ctrl-c's and its still logged
+	if opts.SaveQueries {
+		qs := QuerySave{
+			Query:  req.userQuery(),
+			Prompt: req.systemPrompt(),
+			Answer: answer,
+		}
+
+		saveQuery(qs, historyDirForProvider(provider.Name()), historyTypeForProvider(provider.Name()))
+	}
+
+	return printAnswer(answer, opts)
+}
+
+// Send a request and wait for the whole answer, with the spinner going
+func completeWithSpinner(provider Provider, req ProviderRequest, opts QueryOptions) (ProviderResponse, error) {
+
+	// Make the spinner channel so we can tell when its done
+	spinningComplete := make(chan bool)
+
+	if !opts.Quiet {
+		go spinner(spinningComplete)
+	}
+
+	ctx, cancel := newRequestContext(opts.Timeout)
+	defer cancel()
+
+	resp, err := provider.Complete(ctx, req)
+
+	// Tell the spinner we are done
+	if !opts.Quiet {
+		stopSpinner(spinningComplete)
+	}
+
+	return resp, err
+}
+
+// Print a complete answer in the format asked for. Plain answers are
+// highlighted and typed out unless we are quiet. JSON answers are checked
+// and pretty printed, code answers are cut down to their code blocks
+func printAnswer(answer string, opts QueryOptions) error {
+	switch opts.Format {
+	case "json":
+		document := strings.TrimSpace(answer)
+		if blocks := extractCodeBlocks(document); len(blocks) > 0 {
+			document = strings.TrimSpace(blocks[0])
+		}
+
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, []byte(document), "", "  "); err != nil {
+			return &ProviderError{Kind: ErrorProvider, Provider: "thyme", Message: "the answer is not valid JSON: " + err.Error()}
+		}
+
+		fmt.Println(pretty.String())
+
+	case "code":
+		code := strings.TrimSpace(answer)
+		if blocks := extractCodeBlocks(answer); len(blocks) > 0 {
+			for i := range blocks {
+				blocks[i] = strings.TrimRight(blocks[i], "\n")
+			}
+
+			code = strings.Join(blocks, "\n\n")
+		}
+
+		if !opts.Quiet {
+			code = prettyPrintCode(code, opts.Language)
+		}
+
+		fmt.Println(strings.TrimRight(code, "\n"))
+
+	default:
+		if !opts.Quiet {
+			answer = formatCodeBlocksInMarkdown(answer, opts.Language)
+			typeWriterPrint(answer, true)
+		} else {
+			fmt.Println(answer)
+		}
+	}
+
+	return nil
+}
+
+// Whether the answer has to be complete before it can be printed
+func (opts QueryOptions) wholeAnswer() bool {
+	return opts.Format == "json" || opts.Format == "code"
+}
+
+// What we add to the system prompt when the answer has to be JSON
+const jsonFormatInstruction = "Answer only with valid JSON, without any explanations or code fences."
+
+// Add an instruction to the system prompt, or start one when there is none
+func withSystemInstruction(messages []ProviderMessage, instruction string) []ProviderMessage {
+	if len(messages) > 0 && messages[0].Role == "system" {
+		updated := append([]ProviderMessage{}, messages...)
+		updated[0].Content += "\n\n" + instruction
+		return updated
+	}
+
+	return append([]ProviderMessage{{Role: "system", Content: instruction}}, messages...)
+}
+
+/////////////////
+
+// Build the request that runs a prompt on an input. Kagi's summarizer takes
+// no prompt, so only the input is sent. FastGPT only takes a query, so the
+// prompt goes in front of the input
+func promptRequest(provider Provider, prompt Prompt, input string) ProviderRequest {
+	req := ProviderRequest{
+		Model: prompt.Defaults.Model,
+		Parameters: ProviderParameters{
+			Temperature: prompt.Defaults.Temperature,
+			MaxTokens:   prompt.Defaults.MaxTokens,
+		},
+	}
+
+	// Prompt tests build the request of the provider they record or replay
+	if recorded, ok := provider.(*recordedProvider); ok {
+		provider = recorded.provider
+	}
+
+	kagi, ok := provider.(*KagiProvider)
+	if !ok {
+		req.Messages = buildPromptMessages(prompt.Text, prompt.exampleMessages(), input)
+		return req
+	}
+
+	if kagi.FastGPT && prompt.Text != "" {
+		input = prompt.Text + "\n\n" + input
+	}
+
+	req.Messages = buildPromptMessages("", nil, input)
+	req.Parameters.InputType = "text"
+
+	return req
+}
+
+// The provider with the given name, checked for credentials
+func newProviderByName(name string, config ThymeConfig) (Provider, error) {
+	switch name {
+	case "", "openai":
+		if !config.hasOpenAICredentials() {
+			return nil, &ProviderError{Kind: ErrorAuth, Provider: "openai", Message: "set OPENAI_API_KEY, THYME_AZURE_API_KEY or THYME_OPENAI_BASE_URL"}
+		}
+
+	case "kagi", "fastgpt":
+		if kagiKey == "" {
+			return nil, &ProviderError{Kind: ErrorAuth, Provider: "kagi", Message: "set KAGI_API_KEY"}
+		}
+	}
+
+	return providerByName(name)
+}
+
+// The provider with the given name, without checking its credentials
+func providerByName(name string) (Provider, error) {
+	switch name {
+	case "", "openai":
+		return newOpenAIProvider(), nil
+
+	case "kagi", "fastgpt":
+		return &KagiProvider{FastGPT: name == "fastgpt"}, nil
+	}
+
+	return nil, fmt.Errorf("unknown provider %s, use openai, kagi or fastgpt", name)
+}
+
+/////////////////
+
+// Run a one-shot query against a streaming provider, printing the answer as it
+// arrives. Code blocks are highlighted as soon as they are closed
+func streamProviderQuery(provider StreamingProvider, req ProviderRequest, opts QueryOptions) error {
+
+	// Make the spinner channel so we can tell when its done
+	spinningComplete := make(chan bool)
+	spinning := false
+
+	if !opts.Quiet {
+		go spinner(spinningComplete)
+		spinning = true
+	}
+
+	printer := newMarkdownStreamPrinter(opts.Language, !opts.Quiet)
+
+	ctx, cancel := newRequestContext(opts.Timeout)
+	defer cancel()
+
+	resp, err := provider.Stream(ctx, req, func(token string) {
+
+		// Stop the spinner once the first token is here
+		if spinning {
+			stopSpinner(spinningComplete)
+			spinning = false
+		}
+
+		printer.Write(token)
+	})
+
+	if spinning {
+		stopSpinner(spinningComplete)
+	}
+
+	printer.Flush()
+
+	if err != nil {
+		if printer.started {
+			fmt.Println()
+		}
+
+		return err
+	}
+
+	// One final space (or newline when quiet) to separate the answer, like the typewriter
+	if !opts.Quiet {
+		fmt.Printf(" ")
+	} else {
+		fmt.Println()
+	}
+
+	if opts.SaveQueries {
+		qs := QuerySave{
+			Query:  req.userQuery(),
+			Prompt: req.systemPrompt(),
+			Answer: removeLeadingNewLines(resp.Answer),
+		}
+
+		saveQuery(qs, historyDirForProvider(provider.Name()), historyTypeForProvider(provider.Name()))
+	}
+
+	return nil
+}
+
+/////////////////
+
+// The context a request runs under. Ctrl-C cancels it instead of killing
+// thyme, so the spinner can be stopped and the line cleared first
+func newRequestContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+/////////////////
+
+// The HTTP client every provider sends its requests with, so they all share
+// the same retry behaviour
+func newHTTPClient(config ThymeConfig) *http.Client {
+	return &http.Client{
+		Transport: &retryTransport{
+			base:   http.DefaultTransport,
+			policy: config.retryPolicy(),
+		},
+	}
+}
+
+/////////////////
+
+// The directory history for a provider is saved in
+func historyDirForProvider(name string) string {
+	if name == "kagi" {
+		return os.Getenv("THYME_QUERY_KAGI_LOGGING_DIR")
+	}
+
+	return os.Getenv("THYME_QUERY_LOGGING_DIR")
+}
+
+// The type of history file a provider saves, used in the filename
+func historyTypeForProvider(name string) string {
+	if name == "kagi" {
+		return "summary"
+	}
+
+	return "query"
+}
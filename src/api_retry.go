@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/////////////////
+
+// How failed requests are retried. Shared by every provider through
+// newHTTPClient
+type RetryPolicy struct {
+	MaxAttempts int           // Total attempts, including the first one
+	MaxElapsed  time.Duration // Give up once retrying would go past this
+	BaseDelay   time.Duration // Delay before the first retry, doubled every time
+	MaxDelay    time.Duration // Longest we wait between two attempts
+}
+
+// An http.RoundTripper that retries rate limits (429), server errors (5xx)
+// and network errors with exponential backoff and jitter. A Retry-After
+// header from the server wins over our own backoff when it is longer
+type retryTransport struct {
+	base   http.RoundTripper
+	policy RetryPolicy
+}
+
+/////////////////
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	defer setSpinnerStatus("")
+
+	// RoundTrip must not change the request it was given, so every retry
+	// sends a copy with a fresh body
+	current := req
+
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(current)
+
+		if !shouldRetry(req, resp, err) || attempt >= t.policy.MaxAttempts {
+			return resp, err
+		}
+
+		wait := t.policy.backoff(attempt)
+		if resp != nil {
+			if after := retryAfter(resp); after > wait {
+				wait = after
+			}
+		}
+
+		// Out of time, hand back what we got
+		if time.Since(start)+wait > t.policy.MaxElapsed {
+			return resp, err
+		}
+
+		// We need a fresh body for the next attempt
+		body, bodyErr := rewindBody(req)
+		if bodyErr != nil {
+			return resp, err
+		}
+
+		reason := "network error"
+		if resp != nil {
+			reason = fmt.Sprintf("status %d", resp.StatusCode)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		setSpinnerStatus(fmt.Sprintf("(%s, retrying in %s, attempt %d/%d)",
+			reason, wait.Round(time.Second), attempt+1, t.policy.MaxAttempts))
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		current = req.Clone(req.Context())
+		current.Body = body
+	}
+}
+
+/////////////////
+
+// Whether an attempt failed in a way that is worth trying again
+func shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	// Never retry when the user cancelled or the request timed out
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+}
+
+// Exponential backoff with jitter: somewhere between half and all of
+// BaseDelay * 2^(attempt-1), capped at MaxDelay
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay << (attempt - 1)
+	if delay > p.MaxDelay || delay <= 0 {
+		delay = p.MaxDelay
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Read the Retry-After header, which is either seconds or an HTTP date
+func retryAfter(resp *http.Response) time.Duration {
+	header := resp.Header.Get("Retry-After")
+	if header == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// Get a new copy of the request body so it can be sent again
+func rewindBody(req *http.Request) (io.ReadCloser, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req.Body, nil
+	}
+
+	if req.GetBody == nil {
+		return nil, errors.New("request body cannot be replayed")
+	}
+
+	return req.GetBody()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+	tests := []struct {
+		attempt int
+		full    time.Duration // The delay before jitter
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{80, 30 * time.Second}, // The shift overflows
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			wait := policy.backoff(tt.attempt)
+			if wait < tt.full/2 || wait > tt.full {
+				t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.attempt, wait, tt.full/2, tt.full)
+			}
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		header string
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"", 0, 0},
+		{"7", 7 * time.Second, 7 * time.Second},
+		{"soon", 0, 0},
+		{time.Now().Add(20 * time.Second).UTC().Format(http.TimeFormat), 18 * time.Second, 20 * time.Second},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+
+		if got := retryAfter(resp); got < tt.min || got > tt.max {
+			t.Errorf("retryAfter(%q) = %s, want between %s and %s", tt.header, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		status int
+		err    error
+		want   bool
+	}{
+		{"ok", context.Background(), 200, nil, false},
+		{"bad request", context.Background(), 400, nil, false},
+		{"unauthorized", context.Background(), 401, nil, false},
+		{"rate limited", context.Background(), 429, nil, true},
+		{"server error", context.Background(), 500, nil, true},
+		{"bad gateway", context.Background(), 502, nil, true},
+		{"network error", context.Background(), 0, errors.New("connection reset"), true},
+		{"cancelled", cancelled, 0, context.Canceled, false},
+		{"cancelled rate limit", cancelled, 429, nil, false},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequestWithContext(tt.ctx, "POST", "http://example.com", nil)
+
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+
+		if got := shouldRetry(req, resp, tt.err); got != tt.want {
+			t.Errorf("%s: shouldRetry = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	fast := RetryPolicy{MaxAttempts: 4, MaxElapsed: time.Minute, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+	tests := []struct {
+		name       string
+		policy     RetryPolicy
+		statuses   []int  // What the server answers, one attempt after the other
+		retryAfter string // Sent with every failed answer
+		noGetBody  bool
+		wantStatus int
+		wantTries  int
+	}{
+		{"first try", fast, []int{200}, "", false, 200, 1},
+		{"rate limit then ok", fast, []int{429, 200}, "", false, 200, 2},
+		{"server errors then ok", fast, []int{500, 503, 200}, "", false, 200, 3},
+		{"client errors are not retried", fast, []int{400, 200}, "", false, 400, 1},
+		{"gives up after max attempts", fast, []int{500, 500, 500, 500, 200}, "", false, 500, 4},
+		{"retry-after past max elapsed", RetryPolicy{MaxAttempts: 4, MaxElapsed: time.Second, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}, []int{429, 200}, "5", false, 429, 1},
+		{"body that cannot be replayed", fast, []int{429, 200}, "", true, 429, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			bodies := []string{}
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				data, _ := io.ReadAll(r.Body)
+				bodies = append(bodies, string(data))
+
+				status := tt.statuses[len(bodies)-1]
+				if status != 200 && tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+
+			client := &http.Client{Transport: &retryTransport{base: http.DefaultTransport, policy: tt.policy}}
+
+			req, _ := http.NewRequest("POST", server.URL, strings.NewReader(`{"question":"hi"}`))
+			if tt.noGetBody {
+				req.GetBody = nil
+			}
+
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("the request failed: %v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+
+			if len(bodies) != tt.wantTries {
+				t.Errorf("sent %d times, want %d", len(bodies), tt.wantTries)
+			}
+
+			// Every attempt sends the whole body again
+			for i, body := range bodies {
+				if body != `{"question":"hi"}` {
+					t.Errorf("attempt %d sent %q", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransportCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	policy := RetryPolicy{MaxAttempts: 4, MaxElapsed: time.Minute, BaseDelay: time.Minute, MaxDelay: time.Minute}
+	client := &http.Client{Transport: &retryTransport{base: http.DefaultTransport, policy: policy}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "POST", server.URL, strings.NewReader("{}"))
+
+	start := time.Now()
+	_, err := client.Do(req)
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the deadline", err)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("waited %s for a cancelled request", time.Since(start))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+)
+
+/////////////////
+
+// The name of the function the JSON schema is registered as
+const structuredFunctionName = "structured_response"
+
+// How many times we ask the model to fix an answer that does not follow the schema
+const structuredMaxAttempts = 3
+
+/////////////////
+
+// Run a query whose answer has to follow a JSON schema. The model is made to
+// call a function with the schema as its parameters, the arguments are then
+// validated locally. Invalid answers are sent back with the problems so the
+// model can fix them. Only the validated JSON is printed, so it can be piped
+// into jq
+func runStructuredQuery(provider Provider, req ProviderRequest, opts QueryOptions) error {
+	schema, err := parseJSONSchema(req.Parameters.JSONSchema)
+	if err != nil {
+		return err
+	}
+
+	// The spinner would end up in the JSON when piping
+	showSpinner := !opts.Quiet && isatty.IsTerminal(os.Stdout.Fd())
+
+	var problems []string
+
+	for attempt := 1; attempt <= structuredMaxAttempts; attempt++ {
+		spinningComplete := make(chan bool)
+
+		if showSpinner {
+			go spinner(spinningComplete)
+		}
+
+		ctx, cancel := newRequestContext(opts.Timeout)
+		resp, err := provider.Complete(ctx, req)
+		cancel()
+
+		if showSpinner {
+			stopSpinner(spinningComplete)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Some models answer in the content instead of calling the function
+		arguments := resp.Answer
+		if resp.FunctionCall != nil {
+			arguments = resp.FunctionCall.Arguments
+		}
+
+		problems = validateJSONAgainstSchema([]byte(arguments), schema)
+
+		if len(problems) == 0 {
+			var pretty bytes.Buffer
+			if err := json.Indent(&pretty, []byte(strings.TrimSpace(arguments)), "", "  "); err != nil {
+				return err
+			}
+
+			if opts.SaveQueries {
+				qs := QuerySave{
+					Query:  req.userQuery(),
+					Prompt: req.systemPrompt(),
+					Answer: pretty.String(),
+				}
+
+				saveQuery(qs, historyDirForProvider(provider.Name()), historyTypeForProvider(provider.Name()))
+			}
+
+			fmt.Println(pretty.String())
+			return nil
+		}
+
+		// Show the model what it sent and what is wrong with it
+		req.Messages = append(req.Messages,
+			ProviderMessage{
+				Role:         "assistant",
+				FunctionCall: &ProviderFunctionCall{Name: structuredFunctionName, Arguments: arguments},
+			},
+			ProviderMessage{
+				Role:    "function",
+				Name:    structuredFunctionName,
+				Content: "The arguments do not follow the schema, please call the function again and fix these problems:\n- " + strings.Join(problems, "\n- "),
+			},
+		)
+	}
+
+	return &ProviderError{
+		Kind:     ErrorProvider,
+		Provider: provider.Name(),
+		Message:  fmt.Sprintf("the answer did not follow the JSON schema after %d attempts:\n- %s", structuredMaxAttempts, strings.Join(problems, "\n- ")),
+	}
+}
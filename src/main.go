@@ -3,10 +3,12 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 
-	openai "github.com/sashabaranov/go-openai"
+	"github.com/mattn/go-isatty"
 )
 
 // Help message to display when the user asks for help or
@@ -14,18 +16,25 @@ import (
 func helpMessage() {
 	helpStr := `
 Usage: thyme <flags> <input file>
+       thyme pick <flags> <input file>
+       thyme prompt test [flags] [test files or directories]
+       thyme export <history file> [-format md|html|json] [-o file]
 
 Flags:
   -a string
         Ask a question and get a response
   -c string
         Pass a custom prompt to the GPT request. Cannot be used with -p.
+  -chain string
+        Run prompts one after the other, each on the output of the one before: -chain summarize-text,listify. -c adds a custom last step.
   -chat
-        Start a chat session with the GPT model. Must be used with -oa. Can be used with -file to chat about a file.
+        Start a chat session with the GPT model, on OpenAI. Can be used with -file to chat about files, globs and directories. -p or -c sets the system prompt.
   -file string
         Pass file to the prompt. Cannot be used with -a.
+  -format string
+        How to print the answer: plain, json (checked and pretty printed) or code (only the code blocks). Defaults to plain.
   -history string
-        Review the history of your queries, or a specific one. -history [chat, summary, query, all, <full-path-to-history-file>]
+        Review the history of your queries, or a specific one. -history [chat, summary, query, chain, all, <full-path-to-history-file>]
   -ksum string
         Use the Kagi Universal Summarizer API. -ksum [text | url]. Also works with -model
   -ktype string
@@ -33,14 +42,30 @@ Flags:
   -l    List all available prompts (-p) and their descriptions. Will exit.
   -lang string
         The language to format the response syntax for. Omit to 'guess'.
+  -maxtokens int
+        The most tokens OpenAI may answer with.
   -model string
         The model to use for the request. OpenAI: [chatgpt, gpt4] Kagi: [agnes, daphne, muriel($$)]. Defaults are chatgpt and agnes.
   -oa
         Use the OpenAI API.
   -p string
-        The prompt to use for the GPT request: thyme -p active_voice my_blog_post.txt
+        The prompt to use for the GPT request, by name or prompt file: thyme -p active_voice my_blog_post.txt. Without a name, pick it from a list.
+  -pick
+        Pick the prompt from a fuzzy finder, then run it on the -file, -a text or stdin. Same as thyme pick.
   -quiet
         Will omit the spinner, typewriter, and color effects.
+  -resume string
+        Carry on with a saved chat, with its model and system prompt: -chat -resume [latest, <full-path-to-chat-file>]
+  -temperature float
+        The sampling temperature for OpenAI, between 0 and 2. Higher is more random.
+  -template
+        Fill in the -c text as a prompt template, with -var and the built-in variables. Without it the text is sent as written.
+  -timeout duration
+        How long to wait for an answer before giving up, e.g. 30s or 2m. Defaults to THYME_TIMEOUT or 5m.
+  -tui
+        Chat full screen instead of at a plain prompt. Same as THYME_CHAT_UI=full, dumb terminals always get the plain prompt.
+  -var value
+        Set a variable for the prompt template: -var audience=beginners. Can be given more than once.
           
 `
 
@@ -54,7 +79,7 @@ func readFileToString(filename string) string {
 	file, err := ioutil.ReadFile(filename)
 
 	if err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 	}
 
 	return string(file)
@@ -68,13 +93,23 @@ func main() {
 		os.Exit(0)
 	}
 
-	// If the env argument OPEN_AI_API key does not exist, exit
-	// with an error message
-	if os.Getenv("OPENAI_API_KEY") == "" {
-		fmt.Println("Please set the OPENAI_API_KEY environment variable")
+	// Subcommands come before any flags: thyme prompt test ...
+	if os.Args[1] == "prompt" {
+		if len(os.Args) > 2 && os.Args[2] == "test" {
+			os.Exit(runPromptTests(os.Args[3:]))
+		}
+
+		fmt.Fprintln(os.Stderr, "Usage: thyme prompt test [flags] [test files or directories]")
 		os.Exit(1)
 	}
 
+	if os.Args[1] == "export" {
+		os.Exit(runExport(os.Args[2:]))
+	}
+
+	// thyme pick and -p without a name open the prompt picker
+	os.Args = expandPickArgs(os.Args)
+
 	// Are we saving queries today?
 	sq := os.Getenv("THYME_QUERY_LOGGING")
 	saveQueries := false
@@ -92,38 +127,34 @@ func main() {
 	animationFlagVal := flag.Bool("quiet", false, "Will omit the spinner, typewriter, and color effects.")
 	listFlag := flag.Bool("l", false, "List all available prompts (-p) and their descriptions. Will exit.")
 	questionFlag := flag.String("a", "", "Ask a question and get a response")
-	promptFlag := flag.String("p", "", "The prompt to use for the GPT request: thyme -p active_voice my_blog_post.txt")
+	promptFlag := flag.String("p", "", "The prompt to use for the GPT request, by name or prompt file: thyme -p active_voice my_blog_post.txt. Without a name, pick it from a list.")
+	pickFlag := flag.Bool("pick", false, "Pick the prompt from a fuzzy finder, then run it on the -file, -a text or stdin. Same as thyme pick.")
 	customPromptFlag := flag.String("c", "", "Pass a custom prompt to the GPT request. Cannot be used with -p.")
 	modelFlag := flag.String("model", "", "The model to use for the request. OpenAI: [chatgpt, gpt4] Kagi: [agnes, daphne, muriel($$)]. Defaults are chatgpt and agnes.")
-	chatFlag := flag.Bool("chat", false, "Start a chat session with the GPT model. Must be used with -oa. Can be used with -file to chat about a file.")
+	chatFlag := flag.Bool("chat", false, "Start a chat session with the GPT model, on OpenAI. Can be used with -file to chat about files, globs and directories. -p or -c sets the system prompt.")
+	resumeFlag := flag.String("resume", "", "Carry on with a saved chat, with its model and system prompt: -chat -resume [latest, <full-path-to-chat-file>]")
 	kagiFlag := flag.String("ksum", "", "Use the Kagi Universal Summarizer API. -ksum [text | url]. Also works with -model")
 	kagiGPTFlag := flag.Bool("kgpt", false, "Use the Kagi FastGPT API. -ksum [query text]. Always defaults to web_search=true")
 	kagiTypeFlag := flag.String("ktype", "", "Type of summary from the Kagi Universal Summarizer API. -ktype [summary,notes]. 'summary' gives a paragraph, 'notes' gives points.")
 	openAIFlag := flag.Bool("oa", false, "Use the OpenAI API.")
 	fileFlag := flag.String("file", "", "Pass file to the prompt. Cannot be used with -a.")
-	jsonFlag := flag.String("json", "", "Give a json schema file to send as a FunctionCall to get a structured response.")
+	jsonFlag := flag.String("json", "", "Give a json schema file to get a structured response that follows it. The answer is validated and only the JSON is printed.")
+	formatFlag := flag.String("format", "", "How to print the answer: plain, json (checked and pretty printed) or code (only the code blocks). Defaults to plain.")
+	temperatureFlag := flag.Float64("temperature", 0, "The sampling temperature for OpenAI, between 0 and 2. Higher is more random.")
+	maxTokensFlag := flag.Int("maxtokens", 0, "The most tokens OpenAI may answer with.")
 	langFlag := flag.String("lang", "", "The language to format the response syntax for. Omit to 'guess'.")
-	historyFlag := flag.String("history", "", "Review the history of your queries, or a specific one. -history [chat, summary, query, all, <full-path-to-history-file>]")
+	templateFlag := flag.Bool("template", false, "Fill in the -c text as a prompt template, with -var and the built-in variables. Without it the text is sent as written.")
+	timeoutFlag := flag.Duration("timeout", 0, "How long to wait for an answer before giving up, e.g. 30s or 2m. Defaults to THYME_TIMEOUT or 5m.")
+	tuiFlag := flag.Bool("tui", false, "Chat full screen instead of at a plain prompt. Same as THYME_CHAT_UI=full, dumb terminals always get the plain prompt.")
+	promptVars := PromptVars{}
+	flag.Var(promptVars, "var", "Set a variable for the prompt template: -var audience=beginners. Can be given more than once.")
+	chainFlag := flag.String("chain", "", "Run prompts one after the other, each on the output of the one before: -chain summarize-text,listify. -c adds a custom last step.")
+	historyFlag := flag.String("history", "", "Review the history of your queries, or a specific one. -history [chat, summary, query, chain, all, <full-path-to-history-file>]")
 	flag.Parse()
 
-	// A map of string names to our models
-	openAIModels := map[string]string{
-		"chatgpt":       openai.GPT3Dot5Turbo,
-		"gpt4":          openai.GPT4,
-		"gpt4-32k":      openai.GPT432K,
-		"gpt4-0613":     openai.GPT40613,
-		"gpt4-32k-0613": openai.GPT432K0613,
-	}
-
-	kagiModels := map[string]string{
-		"agnes":  "agnes",
-		"daphne": "daphne",
-		"muriel": "muriel",
-	}
-
 	// If the user passed -l, list the available prompts and exit
 	if *listFlag == true {
-		listAvailablePrompts()
+		listAvailablePrompts(prompts)
 		os.Exit(0)
 	}
 
@@ -135,219 +166,391 @@ func main() {
 
 	// If the user passed _both_ -c and -p we need to tell them this is not supported
 	if *customPromptFlag != "" && *promptFlag != "" {
-		fmt.Println("You cannot use both -c and -p. Please use one or the other.")
+		fmt.Fprintln(os.Stderr, "You cannot use both -c and -p. Please use one or the other.")
 		os.Exit(1)
 	}
 
 	// If they passed both a file an a question tell them no
 	if *fileFlag != "" && *questionFlag != "" {
-		fmt.Println("You cannot use both -file and -a. Please use one or the other.")
+		fmt.Fprintln(os.Stderr, "You cannot use both -file and -a. Please use one or the other.")
 		os.Exit(1)
 	}
 
-	// Make the spinner channel so we can tell when its done
-	spinningComplete := make(chan bool)
+	// A chat can be about several files, globs and directories, the -file
+	// one and any that follow the flags
+	chatFiles := []string{}
+	if *chatFlag {
+		if *fileFlag != "" {
+			chatFiles = append(chatFiles, *fileFlag)
+		}
 
-	// Handle requests. This is the order flags are checked in. Each one will exit
-	// So we only ever use one call per execution.
+		chatFiles = append(chatFiles, flag.Args()...)
+	}
 
-	// Handle a Kagi API
-	if *kagiFlag != "" || *kagiGPTFlag == true {
+	// Only chats can be resumed
+	if *resumeFlag != "" && (!*chatFlag || len(chatFiles) > 0) {
+		fmt.Fprintln(os.Stderr, "-resume carries on with a saved chat, use it with -chat and without -file.")
+		os.Exit(1)
+	}
+
+	// Chats always run on OpenAI, -oa is not needed for them
+	if *chatFlag {
+		*openAIFlag = true
+	}
 
-		// Start the spinner
-		if *animationFlagVal == false {
-			go spinner(spinningComplete)
+	config := loadConfig()
+
+	// Let the user choose the prompt when they asked to pick one
+	if *pickFlag {
+		if *promptFlag != "" || *customPromptFlag != "" || *chainFlag != "" {
+			fmt.Fprintln(os.Stderr, "You cannot pick a prompt and pass one with -p, -c or -chain. Please use one or the other.")
+			os.Exit(1)
 		}
 
-		if *questionFlag == "" {
-			fmt.Println("Please pass either a URL or text after -a: thyme -ksum -a https://a.com")
+		picked, ok, err := pickPrompt(prompts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open the prompt picker:", err)
 			os.Exit(1)
 		}
 
-		// We default to agnes, but if the user passes a different one we use that
-		var engineChoice string
+		if !ok {
+			os.Exit(cancelledExitCode)
+		}
 
-		if *modelFlag != "" {
-			engineChoice = kagiModels[*modelFlag]
-		} else {
-			engineChoice = "agnes"
+		*promptFlag = picked.Name
+	}
+
+	// Look up the prompt first, its defaults decide how the rest runs.
+	// A custom prompt from -c has none
+	var prompt Prompt
+
+	if *customPromptFlag != "" {
+		prompt = Prompt{Name: "-c", Text: *customPromptFlag, Literal: !*templateFlag}
+	} else if *promptFlag != "" {
+		found, ok := prompts[*promptFlag]
+
+		// A prompt file can be given by its path too
+		if !ok && isPromptFile(*promptFlag) && doesFileExist(*promptFlag) {
+			var err error
+
+			found, err = loadSinglePromptFile(*promptFlag)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Could not load the prompt file:", err)
+				os.Exit(1)
+			}
+
+			ok = true
 		}
 
-		kagi := KagiRequest{
-			Engine:      engineChoice,
-			Input:       *questionFlag,
-			Type:        *kagiFlag,
-			SummaryType: *kagiTypeFlag,
+		if !ok {
+			fmt.Fprintf(os.Stderr, "There is no prompt called %s, see thyme -l for the list.\n", *promptFlag)
+			os.Exit(1)
 		}
 
-		if *kagiGPTFlag != false {
-			kagi.Type = "fastgpt"
-			kagi.SummaryType = "fastgpt"
-			kagi.Engine = "fastgpt"
+		if !*animationFlagVal {
+			warnPromptCollision(found)
 		}
 
-		response := makeKagiRequest(kagi)
+		prompt = found
+	}
 
-		// Tell the spinner we are done and print the response
-		if *animationFlagVal == false {
-			spinningComplete <- true
-			typeWriterPrint(response.Data.Output, false)
-			os.Exit(0)
+	// Flags given on the command line win over the prompt's defaults
+	settings := prompt.Defaults
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "model":
+			settings.Model = *modelFlag
+		case "temperature":
+			temperature := float32(*temperatureFlag)
+			settings.Temperature = &temperature
+		case "maxtokens":
+			settings.MaxTokens = *maxTokensFlag
+		case "format":
+			settings.Format = *formatFlag
+		case "lang":
+			settings.Language = *langFlag
 		}
+	})
 
-		fmt.Println(response.Data.Output)
-		os.Exit(0)
+	// A picked prompt runs even without -oa
+	if *pickFlag && settings.Provider == "" {
+		settings.Provider = "openai"
+	}
 
+	if settings.Format != "" && !isOutputFormat(settings.Format) {
+		fmt.Fprintf(os.Stderr, "Unknown format %s, use %s.\n", settings.Format, strings.Join(outputFormats, ", "))
+		os.Exit(1)
 	}
 
-	// Handle an OpenAI Request
-	if *openAIFlag == true {
+	opts := QueryOptions{
+		Quiet:       *animationFlagVal,
+		Language:    settings.Language,
+		SaveQueries: saveQueries,
+		Format:      settings.Format,
+		Timeout:     config.Timeout,
+	}
 
-		// We default to chatgpt, but if the user passes a different one we use that
-		var engineChoice string
+	if *timeoutFlag > 0 {
+		opts.Timeout = *timeoutFlag
+	}
 
-		if *modelFlag != "" {
-			engineChoice = *modelFlag
-		} else {
-			engineChoice = "chatgpt"
+	// JSON and code answers are meant to be piped, keep the spinner and colors
+	// out of them. The same goes for chats whose replies are piped
+	if (opts.wholeAnswer() || *chatFlag) && !isatty.IsTerminal(os.Stdout.Fd()) {
+		opts.Quiet = true
+	}
+
+	// The input is the file, the -a text, or whatever is piped in. The usage
+	// line's <input file> works the same as -file
+	if *fileFlag == "" && *questionFlag == "" && !*chatFlag && flag.NArg() == 1 {
+		*fileFlag = flag.Arg(0)
+	}
+
+	var input string
+
+	// Chats read their files themselves
+	if *fileFlag != "" && !*chatFlag {
+		input = readFileToString(*fileFlag)
+	} else if *questionFlag != "" {
+		input = *questionFlag
+	} else if !*chatFlag && *kagiFlag == "" && !*kagiGPTFlag && !isatty.IsTerminal(os.Stdin.Fd()) {
+		piped, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading stdin:", err)
+			os.Exit(1)
 		}
 
-		// If the user wishes to chat, lets do that
-		if *chatFlag == true {
+		input = string(piped)
+	}
 
-			// If the user wants to chat about a file
-			if *fileFlag != "" {
-				gptChat(openAIModels[engineChoice], true, *langFlag, *fileFlag)
-				os.Exit(0)
-			}
+	// A chat starts from one prompt, the steps of a chain have nowhere to go
+	if *chatFlag && (*chainFlag != "" || prompt.isChain()) {
+		fmt.Fprintln(os.Stderr, "A chain cannot be used with -chat. Use -p with a single prompt, or -c.")
+		os.Exit(1)
+	}
 
-			gptChat(openAIModels[engineChoice], false, *langFlag)
-			os.Exit(0)
-		}
+	// Chains pick a provider for every step themselves
+	var chain *Prompt
 
-		// Enable the spinner if it is not disabled
-		if *animationFlagVal == false {
-			go spinner(spinningComplete)
+	if *chainFlag != "" {
+		if *promptFlag != "" {
+			fmt.Fprintln(os.Stderr, "You cannot use both -chain and -p. Please use one or the other.")
+			os.Exit(1)
 		}
 
-		// Get the value after the -p flag
-		prompt := promptFlag
-		var request string
-		var chosenPrompt string
+		adhoc := chainFromFlags(*chainFlag, *customPromptFlag, !*templateFlag)
+		chain = &adhoc
+	} else if prompt.isChain() {
+		chain = &prompt
+	}
 
-		// If the user passed -a then we want to use the text after the flag
-		if *fileFlag != "" {
-			request = readFileToString(*fileFlag)
-		} else if *questionFlag != "" {
-			request = *questionFlag
+	if chain != nil {
+		if *jsonFlag != "" {
+			fmt.Fprintln(os.Stderr, "You cannot use -json with a chain.")
+			os.Exit(1)
 		}
 
-		// Load the prompt from the list
-		// If we passed a -c flag, replace the prompt with the custom text
+		if input == "" {
+			fmt.Fprintln(os.Stderr, "Please pass the chain's input with -file or -a.")
+			os.Exit(1)
+		}
 
-		if *customPromptFlag != "" {
-			chosenPrompt = *customPromptFlag
-		} else {
-			chosenPrompt = prompts[*prompt].Text
+		vars := promptTemplateVars(*fileFlag, input, opts.Language, promptVars)
+
+		plans, err := planChain(*chain, prompts, *modelFlag, vars, config)
+		if err != nil {
+			exitWithError(err)
 		}
 
-		// -a flag will allow us to just ask a question and get a response
-		// Exit after we display the response
-		if *questionFlag != "" {
+		if err := runChain(*chain, plans, input, promptVars, *fileFlag, opts); err != nil {
+			exitWithError(err)
+		}
 
-			var response string
+		os.Exit(0)
+	}
 
-			if *promptFlag != "" && *customPromptFlag != "" {
+	// Handle requests. Pick the provider from the flags, or the prompt's
+	// default, and build its request, then run the query the same way for
+	// every provider.
+	var provider Provider
+	var request ProviderRequest
 
-				if *jsonFlag != "" {
+	// Handle a Kagi API
+	if *kagiFlag != "" || *kagiGPTFlag == true {
 
-					jsonBytes, err := ioutil.ReadFile(*jsonFlag)
+		if *questionFlag == "" {
+			fmt.Fprintln(os.Stderr, "Please pass either a URL or text after -a: thyme -ksum -a https://a.com")
+			os.Exit(1)
+		}
 
-					if err != nil {
-						fmt.Println("Error reading JSON file: ", err)
-						os.Exit(1)
-					}
+		provider = &KagiProvider{FastGPT: *kagiGPTFlag}
+		request.Model = *modelFlag
+		request.Messages = buildPromptMessages("", nil, *questionFlag)
+		request.Parameters.InputType = *kagiFlag
+		request.Parameters.SummaryType = *kagiTypeFlag
 
-					response = callChatGPTFunctionCallNoPrompt(request, chosenPrompt, openAIModels[engineChoice], jsonBytes)
-				} else {
+	} else if *openAIFlag == true || settings.Provider != "" {
 
-					response = callChatGPTNoPrompt(request, openAIModels[engineChoice])
+		providerName := settings.Provider
+		if *openAIFlag {
+			providerName = "openai"
+		}
+
+		if providerName == "openai" {
+
+			// If the env argument OPEN_AI_API key does not exist, exit
+			// with an error message. Local servers do not need one
+			if !config.hasOpenAICredentials() {
+				if config.usingAzure() {
+					fmt.Fprintln(os.Stderr, "Please set the THYME_AZURE_API_KEY environment variable")
+				} else {
+					fmt.Fprintln(os.Stderr, "Please set the OPENAI_API_KEY environment variable, or THYME_OPENAI_BASE_URL for a local server")
 				}
+				os.Exit(errorExitCodes[ErrorAuth])
+			}
 
-			} else {
+			provider = newOpenAIProvider()
+		} else {
+			var err error
 
-				if *jsonFlag != "" {
+			provider, err = newProviderByName(providerName, config)
+			if err != nil {
+				exitWithError(err)
+			}
+		}
 
-					jsonBytes, err := ioutil.ReadFile(*jsonFlag)
+		// If the user wishes to chat, lets do that
+		if *chatFlag == true && providerName == "openai" {
 
-					if err != nil {
-						fmt.Println("Error reading JSON file: ", err)
-						os.Exit(1)
-					}
+			session := newChatSession(provider.ResolveModel(settings.Model))
 
-					response = callChatGPTFunctionCall(request, chosenPrompt, openAIModels[engineChoice], jsonBytes)
+			// The prompt from -p or -c is what the chat is told first
+			if prompt.Text != "" {
+				vars := promptTemplateVars(*fileFlag, "", opts.Language, promptVars)
 
-				} else {
-					response = callChatGPT(request, chosenPrompt, openAIModels[engineChoice])
+				rendered, err := prompt.render(vars)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Error filling in the prompt:", err)
+					os.Exit(1)
 				}
 
+				session.System = rendered.Text
 			}
 
-			// Tell the spinner we are done
-			if *animationFlagVal == false {
-				spinningComplete <- true
+			// A resumed chat keeps its model and system prompt unless
+			// -model, -p or -c say otherwise
+			if *resumeFlag != "" {
+				resumed, err := resumeChatSession(*resumeFlag)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Could not resume the chat:", err)
+					os.Exit(1)
+				}
+
+				if resumed.Model == "" || settings.Model != "" {
+					resumed.Model = session.Model
+				}
+
+				if session.System != "" {
+					resumed.System = session.System
+				}
+
+				session = resumed
 			}
 
-			cleanResponse := removeLeadingNewLines(response)
+			// If the user wants to chat about files, find them all
+			files := []string{}
+
+			if len(chatFiles) > 0 {
+				var skipped []string
+				var err error
+
+				files, skipped, err = collectChatFiles(chatFiles)
 
-			// Save query before we display it incase user ctrl-c's and its still logged
-			qs := QuerySave{
-				Query:  request,
-				Prompt: chosenPrompt,
-				Answer: cleanResponse,
+				for _, file := range skipped {
+					fmt.Fprintf(os.Stderr, "Skipping %s, it is a binary file\n", file)
+				}
+
+				if err != nil {
+					fmt.Fprintln(os.Stderr, "Could not read the files to chat about:", err)
+					os.Exit(1)
+				}
 			}
 
-			if saveQueries {
-				saveGPT(qs)
+			// The full screen chat is asked for, and needs a terminal that
+			// can draw it
+			chat := gptChat
+			if (*tuiFlag || config.ChatUI == "full") && canRunChatTUI() {
+				chat = runChatTUI
 			}
 
-			if *animationFlagVal == false {
-				cleanResponse = formatCodeBlocksInMarkdown(cleanResponse, *langFlag)
-				typeWriterPrint(cleanResponse, true)
-			} else {
-				fmt.Println(cleanResponse)
+			if err := chat(provider, session, config, opts, files...); err != nil {
+				exitWithError(err)
 			}
 
 			os.Exit(0)
 		}
 
-		response := callChatGPT(request, chosenPrompt, openAIModels[engineChoice])
+		query := input
 
-		// Tell the spinner we are done
+		// Prompts are templates, fill them in before anything is sent
+		vars := promptTemplateVars(*fileFlag, query, opts.Language, promptVars)
 
-		if *animationFlagVal == false {
-			spinningComplete <- true
+		rendered, err := prompt.render(vars)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error filling in the prompt:", err)
+			os.Exit(1)
 		}
 
-		cleanResponse := removeLeadingNewLines(response)
+		request = promptRequest(provider, rendered, query)
+		request.Model = settings.Model
+		request.Parameters.Temperature = settings.Temperature
+		request.Parameters.MaxTokens = settings.MaxTokens
+
+		if *jsonFlag != "" {
+			jsonBytes, err := ioutil.ReadFile(*jsonFlag)
+
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error reading JSON file: ", err)
+				os.Exit(1)
+			}
 
-		// Save query before we display it incase user ctrl-c's and its still logged
-		qs := QuerySave{
-			Query:  request,
-			Prompt: chosenPrompt,
-			Answer: cleanResponse,
+			request.Parameters.JSONSchema = jsonBytes
 		}
 
-		if saveQueries {
-			saveGPT(qs)
+	} else {
+		helpMessage()
+		os.Exit(1)
+	}
+
+	err := runProviderQuery(provider, request, opts)
+
+	if err != nil {
+		exitWithError(err)
+	}
+}
+
+/////
+
+// Turn thyme pick, and -p without a prompt name after it, into -pick so the
+// flag package can parse them
+func expandPickArgs(args []string) []string {
+	expanded := []string{args[0]}
+
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+
+		if i == 1 && arg == "pick" {
+			expanded = append(expanded, "-pick")
+			continue
 		}
 
-		if *animationFlagVal == false {
-			cleanResponse = formatCodeBlocksInMarkdown(cleanResponse, *langFlag)
-			typeWriterPrint(cleanResponse, true)
-		} else {
-			fmt.Println(cleanResponse)
+		if (arg == "-p" || arg == "--p") && (i+1 == len(args) || strings.HasPrefix(args[i+1], "-")) {
+			expanded = append(expanded, "-pick")
+			continue
 		}
 
+		expanded = append(expanded, arg)
 	}
+
+	return expanded
 }
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandPickArgs(t *testing.T) {
+	tests := []struct {
+		args string
+		want string
+	}{
+		{"thyme", "thyme"},
+		{"thyme pick", "thyme -pick"},
+		{"thyme pick -file notes.txt", "thyme -pick -file notes.txt"},
+		{"thyme -p", "thyme -pick"},
+		{"thyme --p", "thyme -pick"},
+		{"thyme -p -file notes.txt", "thyme -pick -file notes.txt"},
+		{"thyme -p listify notes.txt", "thyme -p listify notes.txt"},
+		{"thyme -oa -p listify", "thyme -oa -p listify"},
+		{"thyme -oa -a pick", "thyme -oa -a pick"}, // Only the first argument is the subcommand
+		{"thyme -oa -chat -p", "thyme -oa -chat -pick"},
+	}
+
+	for _, tt := range tests {
+		got := expandPickArgs(strings.Fields(tt.args))
+
+		if want := strings.Fields(tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("expandPickArgs(%s) = %q, want %q", tt.args, got, want)
+		}
+	}
+}
+
+// Run thyme's main in a child process with the arguments after --, which
+// TestMain hands over. The test binary stands in for thyme
+func runThyme(t *testing.T, env []string, stdin string, args ...string) (string, error) {
+	cmd := exec.Command(os.Args[0], append([]string{"-test.run=^$", "--"}, args...)...)
+	cmd.Env = append(append(os.Environ(), "THYME_TEST_MAIN=1"), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv("THYME_TEST_MAIN") == "1" {
+		for i, arg := range os.Args {
+			if arg == "--" {
+				os.Args = append([]string{"thyme"}, os.Args[i+1:]...)
+				break
+			}
+		}
+
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestChatWithCustomPrompt(t *testing.T) {
+	server := newFakeChatServer(t, "Hi.")
+	dir := t.TempDir()
+
+	env := []string{
+		"OPENAI_API_KEY=",
+		"THYME_OPENAI_BASE_URL=" + server.URL,
+		"THYME_QUERY_LOGGING_DIR=" + dir,
+		"THYME_INPUT_HISTORY=",
+		"THYME_CHAT_UI=",
+	}
+
+	// -chat runs on OpenAI without -oa, -c is what the chat is told first
+	out, err := runThyme(t, env, "Say hi\n/exit\n", "-chat", "-c", "Be brief.")
+	if err != nil {
+		t.Fatalf("the chat did not start: %v\n%s", err, out)
+	}
+
+	if !strings.Contains(out, "Hi.") {
+		t.Errorf("the answer is missing from the chat:\n%s", out)
+	}
+
+	messages, _ := server.body["messages"].([]interface{})
+	if len(messages) != 2 {
+		t.Fatalf("sent %d messages, want the system prompt and the question", len(messages))
+	}
+
+	if first := messages[0].(map[string]interface{}); first["role"] != "system" || first["content"] != "Be brief." {
+		t.Errorf("first message = %v", first)
+	}
+
+	chats, _ := filepath.Glob(filepath.Join(dir, "*-chat.jsonl"))
+	if len(chats) != 1 {
+		t.Errorf("saved %d chats, want 1", len(chats))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import "sort"
+
+/////////////////
+
+// A chat is a tree of turns. Every saved turn has an ID and the ID of the
+// turn it follows, its Parent, which is 0 for a first turn. Editing an earlier
+// question or asking for another answer adds a turn next to the old one, and
+// with it a new branch. The active branch is the one that ends with the last
+// line of the chat file, so new turns are only ever appended. Taking turns
+// back or switching branches writes the file again, through a temporary file
+// that replaces it whole
+
+// The turns of a chat file with their IDs, in the order they were asked.
+// Chats saved before turns had IDs are numbered one after the other
+func numberChatTurns(lines []ChatHistoryLine) []ChatHistoryLine {
+	turns := make([]ChatHistoryLine, len(lines))
+
+	for i, line := range lines {
+		if line.ID == 0 {
+			line.ID = i + 1
+			if i > 0 {
+				line.Parent = turns[i-1].ID
+			}
+		}
+
+		turns[i] = line
+	}
+
+	sort.SliceStable(turns, func(i, j int) bool {
+		return turns[i].ID < turns[j].ID
+	})
+
+	return turns
+}
+
+// The branch of a chat file that was used last
+func activeChatBranch(lines []ChatHistoryLine) []ChatHistoryLine {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	turns := numberChatTurns(lines)
+	head := lines[len(lines)-1].ID
+	if head == 0 {
+		head = len(lines)
+	}
+
+	return chatBranch(turns, head)
+}
+
+// The turns from the first one down to the turn with the ID
+func chatBranch(turns []ChatHistoryLine, id int) []ChatHistoryLine {
+	byID := map[int]ChatHistoryLine{}
+	for _, turn := range turns {
+		byID[turn.ID] = turn
+	}
+
+	branch := []ChatHistoryLine{}
+
+	// A broken file could make a loop, no branch is longer than the chat
+	for id != 0 && len(branch) < len(turns) {
+		turn, ok := byID[id]
+		if !ok {
+			break
+		}
+
+		branch = append([]ChatHistoryLine{turn}, branch...)
+		id = turn.Parent
+	}
+
+	return branch
+}
+
+// The turns that follow the turn with the ID, or the first turns for 0
+func chatChildren(turns []ChatHistoryLine, id int) []ChatHistoryLine {
+	children := []ChatHistoryLine{}
+
+	for _, turn := range turns {
+		if turn.Parent == id {
+			children = append(children, turn)
+		}
+	}
+
+	return children
+}
+
+// Where every branch ends, in the order they were started. head, the end of
+// the active branch, is one of them even when other branches go on from it
+func chatBranchEnds(turns []ChatHistoryLine, head int) []ChatHistoryLine {
+	ends := []ChatHistoryLine{}
+
+	for _, turn := range turns {
+		if turn.ID == head || len(chatChildren(turns, turn.ID)) == 0 {
+			ends = append(ends, turn)
+		}
+	}
+
+	return ends
+}
+
+// Where a branch parts from another, as the number of the first turn they
+// do not share
+func chatForkTurn(branch []ChatHistoryLine, other []ChatHistoryLine) int {
+	for i := range branch {
+		if i >= len(other) || branch[i].ID != other[i].ID {
+			return i + 1
+		}
+	}
+
+	return len(branch) + 1
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The IDs of some turns, to compare them easily
+func turnIDs(turns []ChatHistoryLine) []int {
+	ids := []int{}
+	for _, turn := range turns {
+		ids = append(ids, turn.ID)
+	}
+	return ids
+}
+
+// A chat where the second question was edited, and the edit was answered
+// twice:
+//
+//	1 ─┬─ 2
+//	   └─ 3 ─┬─ 4
+//	         └─ 5
+func testChatTree() []ChatHistoryLine {
+	return []ChatHistoryLine{
+		{ID: 1, Query: "first"},
+		{ID: 2, Parent: 1, Query: "second"},
+		{ID: 3, Parent: 1, Query: "second, edited"},
+		{ID: 4, Parent: 3, Query: "third"},
+		{ID: 5, Parent: 3, Query: "third, again"},
+	}
+}
+
+func TestNumberChatTurns(t *testing.T) {
+	// Chats saved before turns had IDs are one branch
+	old := numberChatTurns([]ChatHistoryLine{{Query: "a"}, {Query: "b"}, {Query: "c"}})
+
+	for i, turn := range old {
+		if turn.ID != i+1 || turn.Parent != i {
+			t.Errorf("turn %d numbered %d after %d, want %d after %d", i, turn.ID, turn.Parent, i+1, i)
+		}
+	}
+
+	// The active branch's last turn is written last, the turns still come
+	// out in the order they were asked
+	tree := testChatTree()
+	shuffled := []ChatHistoryLine{tree[0], tree[2], tree[3], tree[4], tree[1]}
+
+	if ids := turnIDs(numberChatTurns(shuffled)); !reflect.DeepEqual(ids, []int{1, 2, 3, 4, 5}) {
+		t.Errorf("turns = %v, want them by ID", ids)
+	}
+}
+
+func TestActiveChatBranch(t *testing.T) {
+	tree := testChatTree()
+
+	tests := []struct {
+		name  string
+		lines []ChatHistoryLine
+		want  []int
+	}{
+		{"empty", nil, []int{}},
+		{"the last line ends the branch", tree, []int{1, 3, 5}},
+		{"an older branch written last", []ChatHistoryLine{tree[0], tree[2], tree[3], tree[4], tree[1]}, []int{1, 2}},
+		{"in the middle of the tree", []ChatHistoryLine{tree[0], tree[1], tree[3], tree[4], tree[2]}, []int{1, 3}},
+		{"without IDs", []ChatHistoryLine{{Query: "a"}, {Query: "b"}}, []int{1, 2}},
+	}
+
+	for _, tt := range tests {
+		if ids := turnIDs(activeChatBranch(tt.lines)); !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: branch = %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+}
+
+func TestChatBranch(t *testing.T) {
+	tree := testChatTree()
+
+	tests := []struct {
+		name  string
+		turns []ChatHistoryLine
+		id    int
+		want  []int
+	}{
+		{"to a turn", tree, 4, []int{1, 3, 4}},
+		{"before the first turn", tree, 0, []int{}},
+		{"a missing turn", tree, 9, []int{}},
+		{"a parent that is missing", []ChatHistoryLine{{ID: 2, Parent: 1}}, 2, []int{2}},
+		{"a loop in a broken file", []ChatHistoryLine{{ID: 1, Parent: 2}, {ID: 2, Parent: 1}}, 1, []int{2, 1}},
+	}
+
+	for _, tt := range tests {
+		if ids := turnIDs(chatBranch(tt.turns, tt.id)); !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("%s: branch = %v, want %v", tt.name, ids, tt.want)
+		}
+	}
+}
+
+func TestChatChildrenAndEnds(t *testing.T) {
+	tree := testChatTree()
+
+	children := []struct {
+		id   int
+		want []int
+	}{
+		{0, []int{1}},
+		{1, []int{2, 3}},
+		{3, []int{4, 5}},
+		{5, []int{}},
+	}
+
+	for _, tt := range children {
+		if ids := turnIDs(chatChildren(tree, tt.id)); !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("children of %d = %v, want %v", tt.id, ids, tt.want)
+		}
+	}
+
+	ends := []struct {
+		head int
+		want []int
+	}{
+		{5, []int{2, 4, 5}},
+		{3, []int{2, 3, 4, 5}}, // The head counts even with turns after it
+		{0, []int{2, 4, 5}},
+	}
+
+	for _, tt := range ends {
+		if ids := turnIDs(chatBranchEnds(tree, tt.head)); !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("ends with head %d = %v, want %v", tt.head, ids, tt.want)
+		}
+	}
+}
+
+func TestChatForkTurn(t *testing.T) {
+	tree := testChatTree()
+	branch := func(id int) []ChatHistoryLine { return chatBranch(tree, id) }
+
+	tests := []struct {
+		name   string
+		branch []ChatHistoryLine
+		other  []ChatHistoryLine
+		want   int
+	}{
+		{"edited second question", branch(2), branch(5), 2},
+		{"another third answer", branch(4), branch(5), 3},
+		{"the same branch", branch(5), branch(5), 4},
+		{"a branch that goes on", branch(3), branch(5), 3},
+		{"from the start", branch(5), nil, 1},
+	}
+
+	for _, tt := range tests {
+		if got := chatForkTurn(tt.branch, tt.other); got != tt.want {
+			t.Errorf("%s: fork at %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChatSessionBranches(t *testing.T) {
+	session := &ChatSession{File: filepath.Join(t.TempDir(), "chat.jsonl"), Model: "gpt-4"}
+
+	session.addTurn("first", ChatHistoryLine{Query: "first", Answer: "one"})
+	session.addTurn("second", ChatHistoryLine{Query: "second", Answer: "two"})
+
+	// Edit the second question: go back to the first turn and branch off
+	session.checkout(1)
+	session.addTurn("second, edited", ChatHistoryLine{Query: "second, edited", Answer: "two again"})
+
+	if ids := turnIDs(session.Lines); !reflect.DeepEqual(ids, []int{1, 3}) {
+		t.Fatalf("active branch = %v, want [1 3]", ids)
+	}
+
+	if len(session.Messages) != 4 || session.Messages[2].Content != "second, edited" {
+		t.Errorf("messages = %+v, want the edited branch", session.Messages)
+	}
+
+	// The file resumes on the branch used last
+	history, err := readChatHistoryFile(session.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := turnIDs(activeChatBranch(history.ChatHistoryLines)); !reflect.DeepEqual(ids, []int{1, 3}) {
+		t.Errorf("saved branch = %v, want [1 3]", ids)
+	}
+
+	// Taking the edit back leaves the old branch, and the first turn the head
+	session.dropTurn()
+
+	if ids := turnIDs(session.Turns); !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf("turns after /undo = %v, want [1 2]", ids)
+	}
+
+	history, err = readChatHistoryFile(session.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := turnIDs(activeChatBranch(history.ChatHistoryLines)); !reflect.DeepEqual(ids, []int{1}) {
+		t.Errorf("saved branch after /undo = %v, want [1]", ids)
+	}
+
+	// A turn other branches go on from stays when it is taken back
+	session.checkout(2)
+	session.checkout(1)
+	session.addTurn("another", ChatHistoryLine{Query: "another", Answer: "three"})
+	session.checkout(1)
+	session.dropTurn()
+
+	if ids := turnIDs(session.Turns); !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Errorf("turns after taking back a fork = %v, want [1 2 3]", ids)
+	}
+}
+
+func TestChatSessionRewrite(t *testing.T) {
+	dir := t.TempDir()
+	session := &ChatSession{File: filepath.Join(dir, "chat.jsonl"), Model: "gpt-4"}
+
+	session.addTurn("first", ChatHistoryLine{Query: "first", Answer: "one"})
+	session.addTurn("second", ChatHistoryLine{Query: "second", Answer: "two"})
+	session.checkout(1)
+	session.addTurn("second, edited", ChatHistoryLine{Query: "second, edited", Answer: "two again"})
+
+	// Switching back to the first branch writes it last
+	session.checkout(2)
+	session.rewrite()
+
+	history, err := readChatHistoryFile(session.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ids := turnIDs(history.ChatHistoryLines); !reflect.DeepEqual(ids, []int{1, 3, 2}) {
+		t.Errorf("saved turns = %v, want [1 3 2]", ids)
+	}
+
+	// Only the chat is left in the directory, the temporary file took its place
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("the directory has %d files, want only the chat", len(entries))
+	}
+
+	// Taking back the only turn removes the file
+	single := &ChatSession{File: filepath.Join(dir, "single.jsonl"), Model: "gpt-4"}
+	single.addTurn("only", ChatHistoryLine{Query: "only", Answer: "one"})
+	single.dropTurn()
+
+	if _, err := os.Stat(single.File); !os.IsNotExist(err) {
+		t.Errorf("the chat file is still there: %v", err)
+	}
+}
@@ -0,0 +1,957 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/glamour"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-isatty"
+)
+
+/////////////////
+
+// The full screen chat: the conversation rendered as Markdown above a box to
+// type in, a status bar with the model, tokens and cost, and a sidebar with
+// the saved chats. It has the line mode chat's (gptChat) commands, which run
+// on the same chatREPL
+
+type chatTUI struct {
+	chat  *chatREPL
+	files []string // What the chat is about, sent first
+
+	transcript viewport.Model
+	input      textarea.Model
+	style      string // The glamour style the answers are rendered in
+	markdown   *glamour.TermRenderer
+	rendered   map[int]string // Rendered turns by ID, at renderedAt columns
+	renderedAt int
+
+	sessions []chatSessionEntry // The saved chats in the sidebar, newest first
+	sidebar  bool
+	browsing bool // Whether the keys go to the sidebar
+	cursor   int
+
+	note     string // A warning, error or answer to a command, until the next message
+	warned   bool   // Whether the note is a warning
+	used     int    // Tokens the chat is now
+	limit    int    // The model's context window
+	exact    bool   // Whether used was counted by the tokenizer or estimated
+	cost     float64
+	unpriced bool // Whether a turn was with a model we do not know the price of
+
+	turn   *chatTUITurn
+	events chan tea.Msg
+
+	width  int
+	height int
+	styles chatTUIStyles
+}
+
+type chatTUIStyles struct {
+	you      lipgloss.Style
+	model    lipgloss.Style
+	info     lipgloss.Style
+	warning  lipgloss.Style
+	status   lipgloss.Style
+	selected lipgloss.Style
+	current  lipgloss.Style
+	border   lipgloss.Style
+}
+
+// A question whose answer is coming in
+type chatTUITurn struct {
+	question chatQuestion
+	answer   string // What arrived so far
+	cancel   context.CancelFunc
+	restore  func() // Puts the chat back on the branch it was on, if the question fails
+}
+
+// A saved chat in the sidebar
+type chatSessionEntry struct {
+	File     string
+	Title    string
+	Turns    int
+	Modified time.Time
+}
+
+// What the answer tells the TUI while it comes in, and once it is done.
+// The chat was fitted to the model on a copy, Update takes what changed
+type chatTokenMsg struct {
+	turn *chatTUITurn
+	text string
+}
+type chatNoteMsg string
+type chatDoneMsg struct {
+	answer      string
+	input       int // Tokens the request was
+	interrupted bool
+	asked       bool
+	err         error
+	start       int // Where the copy of the chat was left at, and its summary
+	summary     string
+	limits      map[string]int
+}
+
+// How many saved chats the sidebar lists
+const chatSidebarSessions = 50
+
+/////////////////
+
+// Whether the terminal can draw the full screen chat
+func canRunChatTUI() bool {
+	term := os.Getenv("TERM")
+
+	return isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd()) && term != "" && term != "dumb"
+}
+
+// Chat in the full screen TUI. Returns when the user leaves with Ctrl-C or
+// Ctrl-D, or if the files to chat about could not be read
+func runChatTUI(provider Provider, session *ChatSession, config ThymeConfig, opts QueryOptions, files ...string) error {
+	// Read the files before the screen is taken over, so errors show
+	if len(files) > 0 {
+		if _, err := fileChatMessage(files); err != nil {
+			return err
+		}
+	}
+
+	// The background has to be asked for before Bubble Tea reads the keys
+	style := "dark"
+	if opts.Quiet {
+		style = "notty"
+	} else if !lipgloss.HasDarkBackground() {
+		style = "light"
+	}
+
+	input := textarea.New()
+	input.Placeholder = "Ask away. Enter sends, Alt-Enter or Ctrl-J starts a new line"
+	input.ShowLineNumbers = false
+	input.CharLimit = 0
+	input.Prompt = "┃ "
+	input.KeyMap.InsertNewline.SetKeys("alt+enter", "ctrl+j")
+	input.Focus()
+
+	m := &chatTUI{
+		chat:       newChatREPL(provider, session, config, opts),
+		files:      files,
+		transcript: viewport.New(0, 0),
+		input:      input,
+		style:      style,
+		rendered:   map[int]string{},
+		events:     make(chan tea.Msg, 64),
+		styles: chatTUIStyles{
+			you:      lipgloss.NewStyle().Foreground(lipgloss.Color("#1FC3B7")).Bold(true),
+			model:    lipgloss.NewStyle().Foreground(lipgloss.Color("#8de765")).Bold(true),
+			info:     lipgloss.NewStyle().Foreground(lipgloss.Color("#808080")),
+			warning:  lipgloss.NewStyle().Foreground(lipgloss.Color("#E8B730")),
+			status:   lipgloss.NewStyle().Foreground(lipgloss.Color("#f3f6f4")).Background(lipgloss.Color("#3c3c3c")).Padding(0, 1),
+			selected: lipgloss.NewStyle().Foreground(lipgloss.Color("#04B575")).Bold(true),
+			current:  lipgloss.NewStyle().Foreground(lipgloss.Color("#1FC3B7")),
+			border:   lipgloss.NewStyle().Border(lipgloss.NormalBorder(), false, true, false, false).BorderForeground(lipgloss.Color("#3c3c3c")),
+		},
+	}
+
+	// Only the keys we hand it scroll the conversation, the rest are typed
+	m.transcript.KeyMap = viewport.KeyMap{
+		PageDown: m.transcript.KeyMap.PageDown,
+		PageUp:   m.transcript.KeyMap.PageUp,
+	}
+	m.transcript.KeyMap.PageDown.SetKeys("pgdown")
+	m.transcript.KeyMap.PageUp.SetKeys("pgup")
+
+	// Warnings about the context come while the answer is worked out
+	m.chat.warn = func(format string, a ...interface{}) {
+		m.events <- chatNoteMsg(fmt.Sprintf(format, a...))
+	}
+	m.chat.keys = chatTUIKeys
+
+	m.count()
+
+	program := tea.NewProgram(m, tea.WithAltScreen(), tea.WithMouseCellMotion())
+	_, err := program.Run()
+
+	if m.turn != nil {
+		m.turn.cancel()
+	}
+
+	return err
+}
+
+/////////////////
+
+func (m *chatTUI) Init() tea.Cmd {
+	cmds := []tea.Cmd{textarea.Blink, waitForChatEvent(m.events)}
+
+	// A chat about files starts by sending them
+	if len(m.files) > 0 {
+		sent, _ := fileChatMessage(m.files)
+		m.inform(fileChatSummary(m.chat.session.Model, m.files))
+
+		line := ChatHistoryLine{
+			Query: fmt.Sprintf("%s %s", fileChatPrompt, strings.Join(m.files, ", ")),
+			Files: m.files,
+		}
+
+		cmds = append(cmds, m.startTurn(chatQuestion{sent: sent, line: line}, nil))
+	}
+
+	return tea.Batch(cmds...)
+}
+
+// Wait for the next token or warning of the answer coming in
+func waitForChatEvent(events chan tea.Msg) tea.Cmd {
+	return func() tea.Msg {
+		return <-events
+	}
+}
+
+func (m *chatTUI) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width, m.height = msg.Width, msg.Height
+		m.layout()
+		m.refresh(true)
+		return m, nil
+
+	case tea.MouseMsg:
+		var cmd tea.Cmd
+		m.transcript, cmd = m.transcript.Update(msg)
+		return m, cmd
+
+	case chatTokenMsg:
+		// Tokens of an answer that was stopped can come after it
+		if msg.turn == m.turn {
+			m.turn.answer += msg.text
+			m.refresh(false)
+		}
+		return m, waitForChatEvent(m.events)
+
+	case chatNoteMsg:
+		m.warn(string(msg))
+		m.layout()
+		return m, waitForChatEvent(m.events)
+
+	case chatDoneMsg:
+		m.finishTurn(msg)
+		return m, nil
+
+	case tea.KeyMsg:
+		return m.key(msg)
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	return m, cmd
+}
+
+// Handle a key. Most of them go to the box to type in
+func (m *chatTUI) key(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "ctrl+c":
+		if m.turn != nil {
+			m.turn.cancel()
+			return m, nil
+		}
+		return m, tea.Quit
+
+	case "esc":
+		if m.turn != nil {
+			m.turn.cancel()
+		} else if m.browsing {
+			m.browse(false)
+		}
+		return m, nil
+
+	case "ctrl+d":
+		if m.input.Value() == "" {
+			return m, tea.Quit
+		}
+
+	case "ctrl+y":
+		m.copyCode()
+		return m, nil
+
+	case "ctrl+b":
+		m.sidebar = !m.sidebar
+		if m.sidebar {
+			m.loadSessions()
+		}
+		m.browse(m.sidebar)
+		m.layout()
+		m.refresh(true)
+		return m, nil
+
+	case "tab":
+		if m.sidebar {
+			m.browse(!m.browsing)
+			return m, nil
+		}
+
+	case "pgup", "pgdown":
+		var cmd tea.Cmd
+		m.transcript, cmd = m.transcript.Update(msg)
+		return m, cmd
+	}
+
+	if m.browsing {
+		return m, m.sidebarKey(msg)
+	}
+
+	if msg.String() == "enter" {
+		return m, m.submit()
+	}
+
+	var cmd tea.Cmd
+	m.input, cmd = m.input.Update(msg)
+	m.layout()
+	return m, cmd
+}
+
+// Move the keys to the sidebar, or back to the box to type in
+func (m *chatTUI) browse(sidebar bool) {
+	m.browsing = sidebar
+
+	if sidebar {
+		m.input.Blur()
+	} else {
+		m.input.Focus()
+	}
+}
+
+// Move through the saved chats, Enter carries on with one
+func (m *chatTUI) sidebarKey(msg tea.KeyMsg) tea.Cmd {
+	switch msg.String() {
+	case "up", "k", "ctrl+p":
+		if m.cursor > 0 {
+			m.cursor--
+		}
+
+	case "down", "j", "ctrl+n":
+		if m.cursor < len(m.sessions)-1 {
+			m.cursor++
+		}
+
+	case "enter":
+		if m.turn != nil {
+			m.inform("Wait for the answer, or stop it with Esc, before switching chats")
+			break
+		}
+
+		if m.cursor < len(m.sessions) {
+			m.resume(m.sessions[m.cursor].File)
+		}
+	}
+
+	return nil
+}
+
+/////////////////
+
+// Send what was typed, or run it as a command
+func (m *chatTUI) submit() tea.Cmd {
+	text := strings.TrimSpace(m.input.Value())
+	if text == "" && m.chat.editing == 0 {
+		return nil
+	}
+
+	if m.turn != nil {
+		m.inform("Wait for the answer, or stop it with Esc")
+		return nil
+	}
+
+	m.input.Reset()
+	m.note, m.warned = "", false
+
+	if isChatCommand(text) {
+		cmd := m.command(m.chat.command(text))
+		m.layout()
+		m.refresh(true)
+		return cmd
+	}
+
+	text = strings.TrimPrefix(text, "/")
+
+	// /edit without the new question asks for it next
+	if m.chat.editing > 0 {
+		turn := m.chat.editing
+		m.chat.editing = 0
+
+		cmd := m.command(m.chat.edit(turn, text))
+		m.layout()
+		m.refresh(true)
+		return cmd
+	}
+
+	sent, err := m.chat.withAttachments(text)
+	if err != nil {
+		m.warn(err.Error())
+		m.input.SetValue(text)
+		return nil
+	}
+
+	return m.startTurn(chatQuestion{sent: sent, line: ChatHistoryLine{Query: sent}, typed: text, attached: true}, nil)
+}
+
+// Ask for an answer in the background. The tokens come back as messages, the
+// turn is added once it is done. restore undoes what was done to the chat
+// before, if the question fails
+func (m *chatTUI) startTurn(question chatQuestion, restore func()) tea.Cmd {
+	c := m.chat
+
+	// Esc and Ctrl-C cancel the answer, not the chat
+	ctx, cancel := context.WithCancel(context.Background())
+	if c.opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), c.opts.Timeout)
+	}
+
+	if restore == nil {
+		restore = func() {}
+	}
+
+	turn := &chatTUITurn{question: question, cancel: cancel, restore: restore}
+	m.turn = turn
+
+	// Fitting the chat to the model leaves out or summarizes turns. That is
+	// done on a copy while the View reads the chat, finishTurn takes it over
+	work := *c
+	session := *c.session
+	session.Messages = append([]ProviderMessage{}, c.session.Messages...)
+	work.session = &session
+
+	work.limits = map[string]int{}
+	for model, limit := range c.limits {
+		work.limits[model] = limit
+	}
+
+	work.summarize = func(req ProviderRequest) (ProviderResponse, error) {
+		return c.provider.Complete(ctx, req)
+	}
+
+	events := m.events
+	provider := c.provider
+
+	m.layout()
+	m.refresh(true)
+
+	return func() tea.Msg {
+		input := 0
+
+		answer, interrupted, asked, err := work.answer(question.sent, func(req ProviderRequest) (string, bool, error) {
+			input, _ = countMessagesTokens(req.Model, req.Messages)
+			return streamChatTUITurn(ctx, provider, req, func(token string) {
+				events <- chatTokenMsg{turn: turn, text: token}
+			})
+		})
+
+		return chatDoneMsg{
+			answer:      answer,
+			input:       input,
+			interrupted: interrupted,
+			asked:       asked,
+			err:         err,
+			start:       session.Start,
+			summary:     session.Summary,
+			limits:      work.limits,
+		}
+	}
+}
+
+// Ask a question after an earlier turn, which starts a branch there. If it
+// fails the chat goes back to the branch it was on
+func (m *chatTUI) branchFrom(question chatQuestion) tea.Cmd {
+	session := m.chat.session
+	head, start, summary := session.head(), session.Start, session.Summary
+
+	session.checkout(question.parent)
+
+	return m.startTurn(question, func() {
+		session.checkout(head)
+		session.Start, session.Summary = start, summary
+	})
+}
+
+// Keep the answer, or put the chat back as it was when the question failed
+func (m *chatTUI) finishTurn(msg chatDoneMsg) {
+	turn := m.turn
+	m.turn = nil
+	turn.cancel()
+
+	session := m.chat.session
+	session.Start, session.Summary = msg.start, msg.summary
+	m.chat.limits = msg.limits
+
+	switch {
+	case msg.err != nil || !msg.asked:
+		turn.restore()
+
+		if msg.err != nil {
+			m.warn(strings.TrimSpace(describeError(msg.err)))
+		}
+
+		// Give the question back, so it can be changed or sent again
+		if turn.question.typed != "" && m.input.Value() == "" {
+			m.input.SetValue(turn.question.typed)
+		}
+
+	default:
+		// Keep the reply, even a partial one, so the conversation stays in order
+		line := turn.question.line
+		line.Answer = msg.answer
+		session.addTurn(turn.question.sent, line)
+
+		if turn.question.attached {
+			m.chat.attachments = nil
+		}
+
+		answerTokens, _ := countTokens(session.Model, msg.answer)
+
+		if cost, ok := estimateCost(session.Model, msg.input, answerTokens, m.chat.config); ok {
+			m.cost += cost
+		} else {
+			m.unpriced = true
+		}
+
+		if msg.interrupted {
+			m.inform("Stopped, the answer so far is kept. /retry asks again")
+		} else if turn.question.kept != "" {
+			m.inform(turn.question.kept)
+		}
+	}
+
+	m.count()
+	m.layout()
+	m.refresh(true)
+}
+
+// Send one chat turn and hand the reply to the TUI as it streams in. A
+// cancelled context means the user stopped it, whatever arrived is returned
+// as interrupted
+func streamChatTUITurn(ctx context.Context, provider Provider, req ProviderRequest, token func(string)) (string, bool, error) {
+	var resp ProviderResponse
+	var err error
+
+	if streamer, ok := provider.(StreamingProvider); ok {
+		resp, err = streamer.Stream(ctx, req, token)
+	} else {
+		resp, err = provider.Complete(ctx, req)
+		if err == nil {
+			token(resp.Answer)
+		}
+	}
+
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return resp.Answer, true, nil
+	}
+
+	return resp.Answer, false, err
+}
+
+/////////////////
+
+// The full screen chat's keys, for /help
+const chatTUIKeys = "Enter sends, Alt-Enter or Ctrl-J starts a new line. Esc stops an answer, Ctrl-Y copies its last code block. PgUp and PgDown scroll, Ctrl-B shows the saved chats and Tab moves between them and the box. Ctrl-C or Ctrl-D leaves."
+
+// Show what a chat command has to say above the box, and ask the question it
+// makes
+func (m *chatTUI) command(result chatCommandResult) tea.Cmd {
+	if result.exit {
+		return tea.Quit
+	}
+
+	note := result.output
+	if len(note) > 0 && result.note != "" {
+		note = append(note, "")
+	}
+	if result.note != "" {
+		note = append(note, result.note)
+	}
+	m.inform(strings.Join(note, "\n"))
+
+	if result.prefill != "" {
+		m.input.SetValue(result.prefill)
+	}
+
+	var cmd tea.Cmd
+	if result.question != nil {
+		cmd = m.branchFrom(*result.question)
+	}
+
+	// Turns can be new or gone under the IDs they had
+	m.rendered = map[int]string{}
+	m.count()
+
+	return cmd
+}
+
+// Copy the last code block of the last answer
+func (m *chatTUI) copyCode() {
+	session := m.chat.session
+
+	answer := ""
+	if m.turn != nil {
+		answer = m.turn.answer
+	} else if session.turns() > 0 {
+		answer = session.Lines[len(session.Lines)-1].Answer
+	}
+
+	blocks := extractCodeBlocks(answer)
+	if len(blocks) == 0 {
+		m.inform("The last answer has no code")
+		m.layout()
+		return
+	}
+
+	copyToClipboard(blocks[len(blocks)-1])
+	m.inform("Copied the last code block to the clipboard")
+	m.layout()
+}
+
+// Carry on with a saved chat, the way -resume does
+func (m *chatTUI) resume(file string) {
+	resumed, err := resumeChatSession(file)
+	if err != nil {
+		m.warn(fmt.Sprintf("Could not resume the chat: %s", err))
+		m.layout()
+		return
+	}
+
+	if resumed.Model == "" {
+		resumed.Model = m.chat.session.Model
+	}
+
+	*m.chat.session = *resumed
+	m.chat.attachments = nil
+	m.chat.editing = 0
+	m.rendered = map[int]string{}
+	m.inform(fmt.Sprintf("Resuming %s, %d turns with %s", file, resumed.turns(), resumed.Model))
+
+	m.count()
+	m.browse(false)
+	m.layout()
+	m.refresh(true)
+	m.transcript.GotoBottom()
+}
+
+/////////////////
+
+// Find the saved chats in THYME_QUERY_LOGGING_DIR, the newest first
+func (m *chatTUI) loadSessions() {
+	m.sessions = loadChatSessions(os.Getenv("THYME_QUERY_LOGGING_DIR"))
+	m.cursor = 0
+
+	for i, entry := range m.sessions {
+		if entry.File == m.chat.session.File {
+			m.cursor = i
+		}
+	}
+}
+
+// The saved chats in a directory, by when they were last written to, titled
+// with the first question of the branch used last
+func loadChatSessions(saveDir string) []chatSessionEntry {
+	if saveDir == "" {
+		return nil
+	}
+
+	chats, _ := filepath.Glob(filepath.Join(saveDir, "*-chat.jsonl"))
+
+	entries := []chatSessionEntry{}
+	for _, chat := range chats {
+		if info, err := os.Stat(chat); err == nil {
+			entries = append(entries, chatSessionEntry{File: chat, Modified: info.ModTime()})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Modified.After(entries[j].Modified)
+	})
+
+	if len(entries) > chatSidebarSessions {
+		entries = entries[:chatSidebarSessions]
+	}
+
+	for i, entry := range entries {
+		entries[i].Title = transcriptTitle(entry.File)
+
+		history, err := readChatHistoryFile(entry.File)
+		if err != nil {
+			continue
+		}
+
+		branch := activeChatBranch(history.ChatHistoryLines)
+		if len(branch) > 0 {
+			entries[i].Title = branch[0].Query
+			entries[i].Turns = len(branch)
+		}
+	}
+
+	return entries
+}
+
+/////////////////
+
+// Count the tokens for the status bar, the View only reads what is counted
+// here
+func (m *chatTUI) count() {
+	m.used, m.exact = countMessagesTokens(m.chat.session.Model, m.chat.session.request().Messages)
+	m.limit = m.chat.contextLimit()
+}
+
+// Show a note above the box to type in
+func (m *chatTUI) inform(text string) {
+	m.note = text
+	m.warned = false
+}
+
+// Show a warning above the box to type in
+func (m *chatTUI) warn(text string) {
+	m.note = text
+	m.warned = true
+}
+
+// How wide the sidebar is when it is shown
+func (m *chatTUI) sidebarWidth() int {
+	if !m.sidebar {
+		return 0
+	}
+
+	if m.width < 90 {
+		return m.width / 3
+	}
+
+	return 32
+}
+
+// Size the conversation and the box to type in around the note
+func (m *chatTUI) layout() {
+	if m.width == 0 {
+		return
+	}
+
+	width := m.width - m.sidebarWidth()
+
+	lines := m.input.LineCount()
+	if lines < 2 {
+		lines = 2
+	}
+	if lines > 8 {
+		lines = 8
+	}
+
+	m.input.SetWidth(width)
+	m.input.SetHeight(lines)
+
+	height := m.height - lines - 1
+	if m.note != "" {
+		height -= lipgloss.Height(m.noteView(width))
+	}
+
+	if height < 1 {
+		height = 1
+	}
+
+	bottom := m.transcript.AtBottom()
+
+	m.transcript.Width = width
+	m.transcript.Height = height
+
+	if bottom {
+		m.transcript.GotoBottom()
+	}
+}
+
+// Render the conversation again. It stays at the bottom if it was there, or
+// when follow is set
+func (m *chatTUI) refresh(follow bool) {
+	if m.width == 0 {
+		return
+	}
+
+	bottom := m.transcript.AtBottom()
+
+	m.transcript.SetContent(m.transcriptView(m.transcript.Width))
+
+	if bottom || follow {
+		m.transcript.GotoBottom()
+	}
+}
+
+// The Markdown renderer for the conversation's width
+func (m *chatTUI) renderer(width int) *glamour.TermRenderer {
+	if width != m.renderedAt {
+		m.markdown = nil
+		m.rendered = map[int]string{}
+		m.renderedAt = width
+	}
+
+	if m.markdown == nil {
+		m.markdown, _ = glamour.NewTermRenderer(
+			glamour.WithStandardStyle(m.style),
+			glamour.WithColorProfile(lipgloss.ColorProfile()),
+			glamour.WithWordWrap(width-4),
+		)
+	}
+
+	return m.markdown
+}
+
+// Render an answer as Markdown, as it is if that fails
+func (m *chatTUI) renderMarkdown(text string, width int) string {
+	if r := m.renderer(width); r != nil {
+		if out, err := r.Render(text); err == nil {
+			return strings.TrimRight(out, "\n")
+		}
+	}
+
+	return lipgloss.NewStyle().Width(width).Render(text)
+}
+
+// The whole conversation on the active branch, and the answer coming in
+func (m *chatTUI) transcriptView(width int) string {
+	session := m.chat.session
+	parts := []string{}
+
+	if session.System != "" {
+		parts = append(parts, m.styles.info.Width(width).Render("System: "+session.System))
+	}
+
+	question := func(text string) string {
+		return m.styles.you.Render("You") + "\n" + lipgloss.NewStyle().Width(width).Render(text)
+	}
+
+	model := func(name string) string {
+		if name == "" {
+			name = session.Model
+		}
+		return m.styles.model.Render(name)
+	}
+
+	for _, line := range session.Lines {
+		rendered, ok := m.rendered[line.ID]
+		if !ok {
+			rendered = question(line.Query) + "\n\n" + model(line.Model) + "\n" + m.renderMarkdown(line.Answer, width)
+			m.rendered[line.ID] = rendered
+		}
+
+		parts = append(parts, rendered)
+	}
+
+	if m.turn != nil {
+		answer := m.styles.info.Render("...")
+		if m.turn.answer != "" {
+			answer = m.renderMarkdown(m.turn.answer, width)
+		}
+
+		parts = append(parts, question(m.turn.question.line.Query)+"\n\n"+model("")+"\n"+answer)
+	}
+
+	if len(parts) == 0 {
+		return m.styles.info.Render("Ask anything to start the chat. /help lists the commands and keys.")
+	}
+
+	return strings.Join(parts, "\n\n")
+}
+
+/////////////////
+
+func (m *chatTUI) View() string {
+	if m.width == 0 {
+		return ""
+	}
+
+	width := m.width - m.sidebarWidth()
+
+	main := m.transcript.View()
+	if m.note != "" {
+		main += "\n" + m.noteView(width)
+	}
+	main += "\n" + m.input.View()
+
+	if m.sidebar {
+		main = lipgloss.JoinHorizontal(lipgloss.Top, m.sidebarView(m.sidebarWidth()-1, m.height-1), main)
+	}
+
+	return main + "\n" + m.statusView()
+}
+
+// Warnings, errors and what commands have to say
+func (m *chatTUI) noteView(width int) string {
+	style := m.styles.info
+	if m.warned {
+		style = m.styles.warning
+	}
+
+	return style.Width(width).Render(m.note)
+}
+
+// The model, how much of its context the chat uses, what it cost so far, and
+// the keys
+func (m *chatTUI) statusView() string {
+	c := m.chat
+
+	tokens := fmt.Sprintf("%s/%s tokens", formatCountedTokens(m.used, m.exact), formatTokenCount(m.limit))
+	if m.used > (m.limit-answerReserve(m.limit))*4/5 {
+		tokens = m.styles.warning.Render(tokens)
+	}
+
+	cost := "cost ?"
+	if _, ok := estimateCost(c.session.Model, 0, 0, c.config); ok && !m.unpriced {
+		cost = fmt.Sprintf("~$%.4f", m.cost)
+	}
+
+	keys := "enter send • ctrl+y copy code • ctrl+b chats • ctrl+c quit"
+	if m.turn != nil {
+		keys = "esc stop • ctrl+y copy code"
+	} else if m.browsing {
+		keys = "↑/↓ move • enter open • tab or esc back"
+	}
+
+	if c.editing > 0 {
+		keys = fmt.Sprintf("editing turn %d • %s", c.editing, keys)
+	}
+
+	status := strings.Join([]string{c.session.Model, tokens, cost, keys}, " • ")
+
+	return m.styles.status.Width(m.width).Render(truncateToWidth(status, m.width-2))
+}
+
+// The saved chats, the open one marked and the cursor in sight
+func (m *chatTUI) sidebarView(width int, height int) string {
+	lines := []string{m.styles.model.Render("Chats")}
+
+	if len(m.sessions) == 0 {
+		lines = append(lines, m.styles.info.Width(width-1).Render("No saved chats in THYME_QUERY_LOGGING_DIR"))
+	}
+
+	start := 0
+	if m.cursor >= height-1 {
+		start = m.cursor - height + 2
+	}
+
+	for i := start; i < len(m.sessions) && len(lines) < height; i++ {
+		entry := m.sessions[i]
+		title := truncateToWidth(fmt.Sprintf("%s (%d)", entry.Title, entry.Turns), width-3)
+
+		switch {
+		case i == m.cursor && m.browsing:
+			title = "› " + m.styles.selected.Render(title)
+		case entry.File == m.chat.session.File:
+			title = "  " + m.styles.current.Render(title)
+		default:
+			title = "  " + title
+		}
+
+		lines = append(lines, title)
+	}
+
+	return m.styles.border.Width(width).Height(height).Render(strings.Join(lines, "\n"))
+}
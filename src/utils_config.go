@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/////////////
+
+// Settings read from the environment. Everything Thyme can be configured with
+// lives here so it is read in one place
+type ThymeConfig struct {
+	OpenAIKey     string // OPENAI_API_KEY. Optional when talking to a local server
+	OpenAIBaseURL string // THYME_OPENAI_BASE_URL. Set to use an OpenAI-compatible server
+	LocalModel    string // THYME_LOCAL_MODEL. Default model alias for that server
+
+	AzureEndpoint    string            // THYME_AZURE_ENDPOINT. Set to use Azure OpenAI
+	AzureKey         string            // THYME_AZURE_API_KEY
+	AzureAPIVersion  string            // THYME_AZURE_API_VERSION
+	AzureDeployments map[string]string // THYME_AZURE_DEPLOYMENTS. Model alias to deployment name
+
+	RetryMaxAttempts int           // THYME_RETRY_MAX_ATTEMPTS. 1 turns retries off
+	RetryMaxTime     time.Duration // THYME_RETRY_MAX_TIME. Total time we are willing to spend retrying
+
+	Timeout time.Duration // THYME_TIMEOUT. How long one request may take, 0 for no limit
+
+	ContextStrategy string // THYME_CONTEXT_STRATEGY. What a chat does when it outgrows the model: drop, summarize or refuse
+	ContextLimit    int    // THYME_CONTEXT_LIMIT. The context window of every model in tokens, 0 to go by the model
+
+	ChatUI string // THYME_CHAT_UI. full chats full screen instead of at a plain prompt
+}
+
+/////////////
+
+// Load the configuration from the environment
+func loadConfig() ThymeConfig {
+	config := ThymeConfig{
+		OpenAIKey:     os.Getenv("OPENAI_API_KEY"),
+		OpenAIBaseURL: os.Getenv("THYME_OPENAI_BASE_URL"),
+		LocalModel:    os.Getenv("THYME_LOCAL_MODEL"),
+	}
+
+	if config.LocalModel == "" {
+		config.LocalModel = "llama2"
+	}
+
+	config.AzureEndpoint = os.Getenv("THYME_AZURE_ENDPOINT")
+	config.AzureKey = os.Getenv("THYME_AZURE_API_KEY")
+	config.AzureAPIVersion = os.Getenv("THYME_AZURE_API_VERSION")
+	config.AzureDeployments = parseKeyValueList(os.Getenv("THYME_AZURE_DEPLOYMENTS"))
+
+	if config.AzureAPIVersion == "" {
+		config.AzureAPIVersion = "2023-05-15"
+	}
+
+	config.RetryMaxAttempts = 4
+	if attempts, err := strconv.Atoi(os.Getenv("THYME_RETRY_MAX_ATTEMPTS")); err == nil && attempts > 0 {
+		config.RetryMaxAttempts = attempts
+	}
+
+	config.RetryMaxTime = parseDurationSetting(os.Getenv("THYME_RETRY_MAX_TIME"), 60*time.Second)
+	config.Timeout = parseDurationSetting(os.Getenv("THYME_TIMEOUT"), 5*time.Minute)
+
+	config.ContextStrategy = "drop"
+	if strategy := os.Getenv("THYME_CONTEXT_STRATEGY"); isContextStrategy(strategy) {
+		config.ContextStrategy = strategy
+	}
+
+	if limit, err := strconv.Atoi(os.Getenv("THYME_CONTEXT_LIMIT")); err == nil && limit > 0 {
+		config.ContextLimit = limit
+	}
+
+	config.ChatUI = os.Getenv("THYME_CHAT_UI")
+
+	return config
+}
+
+/////////////
+
+// Parse a duration setting. Takes Go durations (90s, 2m) or plain seconds (90)
+func parseDurationSetting(s string, fallback time.Duration) time.Duration {
+	if s == "" {
+		return fallback
+	}
+
+	if seconds, err := strconv.Atoi(s); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if d, err := time.ParseDuration(s); err == nil {
+		return d
+	}
+
+	return fallback
+}
+
+/////////////
+
+// Parse a comma separated list of key=value pairs: "chatgpt=my-gpt35,gpt4=my-gpt4"
+func parseKeyValueList(s string) map[string]string {
+	pairs := make(map[string]string)
+
+	for _, pair := range strings.Split(s, ",") {
+		key, value, found := strings.Cut(pair, "=")
+		if !found {
+			continue
+		}
+
+		pairs[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return pairs
+}
+
+/////////////
+
+// The retry policy every provider request uses
+func (c ThymeConfig) retryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: c.RetryMaxAttempts,
+		MaxElapsed:  c.RetryMaxTime,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+	}
+}
+
+/////////////
+
+// Whether the OpenAI provider talks to a local OpenAI-compatible server
+// (Ollama, llama.cpp, vLLM, ...) instead of api.openai.com
+func (c ThymeConfig) usingLocalServer() bool {
+	return c.OpenAIBaseURL != "" && !c.usingAzure()
+}
+
+// Whether the OpenAI provider talks to Azure OpenAI deployments
+func (c ThymeConfig) usingAzure() bool {
+	return c.AzureEndpoint != ""
+}
+
+// Whether we have what we need to authenticate with the configured
+// OpenAI-style backend. Local servers do not need a key
+func (c ThymeConfig) hasOpenAICredentials() bool {
+	if c.usingAzure() {
+		return c.AzureKey != ""
+	}
+
+	return c.OpenAIKey != "" || c.usingLocalServer()
+}
+
+/////////////
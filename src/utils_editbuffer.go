@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/mattn/go-runewidth"
+)
+
+/////////////////
+
+// The chat input's keys and message editing, kept apart from the terminal so
+// they can be tested. The line editor reads bytes, turns them into keys with
+// parseEditorKey, and does what apply asks of the terminal
+
+// A key press, or a character to insert when name is empty
+type editorKey struct {
+	r    rune
+	name string
+}
+
+// What a key asks the line editor to do, besides changing the message
+type editAction int
+
+const (
+	editContinue    editAction = iota // Keep editing
+	editSend                          // Enter finished the message
+	editCancel                        // Ctrl-C on an empty message
+	editEOF                           // Ctrl-D on an empty message
+	editDiscard                       // Ctrl-C with text: drop it and start over
+	editClearScreen                   // Ctrl-L
+	editOpenEditor                    // Ctrl-X Ctrl-E
+)
+
+// What is being typed, and where the last render left the cursor
+type editState struct {
+	prompt      string
+	promptWidth int
+	buf         []rune
+	pos         int
+	cursorRow   int // Rows below the prompt's row
+	endRow      int
+	history     []string
+	historyPos  int
+	draft       []rune // What was typed before going back in the history
+	ctrlX       bool
+	pasting     bool
+	pastedCR    bool
+}
+
+func newEditState(prompt string, history []string) *editState {
+	return &editState{prompt: prompt, promptWidth: lipgloss.Width(prompt), history: history, historyPos: len(history)}
+}
+
+/////////////////
+
+// Read one key from the start of the input. Returns false when the input
+// ends in the middle of one
+func parseEditorKey(b []byte) (editorKey, []byte, bool) {
+	named := func(name string, n int) (editorKey, []byte, bool) {
+		return editorKey{name: name}, b[n:], true
+	}
+
+	switch b[0] {
+	case 0x1b:
+		if len(b) < 2 {
+			return editorKey{}, b, false
+		}
+
+		switch b[1] {
+		case '[':
+			// CSI sequences end with a byte from @ to ~
+			for i := 2; i < len(b); i++ {
+				if b[i] >= 0x40 && b[i] <= 0x7e {
+					return named(csiKeys[string(b[2:i+1])], i+1)
+				}
+			}
+			return editorKey{}, b, false
+
+		case 'O':
+			if len(b) < 3 {
+				return editorKey{}, b, false
+			}
+			return named(csiKeys[string(b[2:3])], 3)
+
+		case '\r', '\n':
+			return named("alt+enter", 2)
+		case 'b':
+			return named("word-left", 2)
+		case 'f':
+			return named("word-right", 2)
+		case 0x7f, 0x08:
+			return named("alt+backspace", 2)
+		}
+
+		return named("unknown", 1)
+
+	case '\r':
+		return named("enter", 1)
+	case '\n':
+		return named("ctrl+j", 1)
+	case '\t':
+		return named("tab", 1)
+	case 0x7f, 0x08:
+		return named("backspace", 1)
+	}
+
+	if b[0] < 0x20 {
+		return named("ctrl+"+string(rune('a'+b[0]-1)), 1)
+	}
+
+	if !utf8.FullRune(b) {
+		return editorKey{}, b, false
+	}
+
+	r, size := utf8.DecodeRune(b)
+	return editorKey{r: r}, b[size:], true
+}
+
+// The keys sent as CSI or SS3 sequences, by what follows ESC [ or ESC O
+var csiKeys = map[string]string{
+	"A":        "up",
+	"B":        "down",
+	"C":        "right",
+	"D":        "left",
+	"H":        "home",
+	"F":        "end",
+	"1~":       "home",
+	"7~":       "home",
+	"4~":       "end",
+	"8~":       "end",
+	"3~":       "delete",
+	"1;3C":     "word-right",
+	"1;5C":     "word-right",
+	"1;3D":     "word-left",
+	"1;5D":     "word-left",
+	"13;2u":    "alt+enter",
+	"27;2;13~": "alt+enter",
+	"200~":     "paste-start",
+	"201~":     "paste-end",
+}
+
+/////////////////
+
+// Edit the message for one key. Returns what the terminal has to do, and the
+// message when it was sent
+func (s *editState) apply(key editorKey) (editAction, string) {
+	// Everything in a paste is text, \r\n is one new line
+	if s.pasting {
+		switch {
+		case key.name == "paste-end":
+			s.pasting = false
+		case key.name == "enter":
+			s.insert('\n')
+		case key.name == "ctrl+j" && !s.pastedCR:
+			s.insert('\n')
+		case key.name == "tab":
+			s.insert('\t')
+		case key.name == "":
+			s.insert(key.r)
+		}
+
+		s.pastedCR = key.name == "enter"
+		return editContinue, ""
+	}
+
+	if s.ctrlX {
+		s.ctrlX = false
+
+		if key.name == "ctrl+e" {
+			return editOpenEditor, ""
+		}
+	}
+
+	switch key.name {
+	case "":
+		s.insert(key.r)
+	case "tab":
+		s.insert('\t')
+	case "paste-start":
+		s.pasting = true
+	case "alt+enter", "ctrl+j":
+		s.insert('\n')
+
+	case "enter":
+		if text, done := s.submit(); done {
+			return editSend, text
+		}
+		s.insert('\n')
+
+	case "ctrl+c":
+		if len(s.buf) == 0 {
+			return editCancel, ""
+		}
+		return editDiscard, ""
+
+	case "ctrl+d":
+		if len(s.buf) == 0 {
+			return editEOF, ""
+		}
+		s.delete(s.pos, s.pos+1)
+
+	case "backspace":
+		s.delete(s.pos-1, s.pos)
+	case "delete":
+		s.delete(s.pos, s.pos+1)
+	case "ctrl+w", "alt+backspace":
+		s.delete(s.wordLeft(), s.pos)
+	case "ctrl+u":
+		s.delete(s.lineStart(), s.pos)
+	case "ctrl+k":
+		// At the end of a line, join it with the next one
+		if end := s.lineEnd(); end > s.pos {
+			s.delete(s.pos, end)
+		} else {
+			s.delete(s.pos, s.pos+1)
+		}
+
+	case "left", "ctrl+b":
+		s.moveTo(s.pos - 1)
+	case "right", "ctrl+f":
+		s.moveTo(s.pos + 1)
+	case "word-left":
+		s.moveTo(s.wordLeft())
+	case "word-right":
+		s.moveTo(s.wordRight())
+	case "home", "ctrl+a":
+		s.moveTo(s.lineStart())
+	case "end", "ctrl+e":
+		s.moveTo(s.lineEnd())
+
+	// Up and Down move between the lines of a message, and past its first
+	// or last line through the history
+	case "up", "ctrl+p":
+		if s.lineStart() > 0 {
+			s.moveLine(-1)
+		} else {
+			s.historyMove(-1)
+		}
+	case "down", "ctrl+n":
+		if s.lineEnd() < len(s.buf) {
+			s.moveLine(1)
+		} else {
+			s.historyMove(1)
+		}
+
+	case "ctrl+l":
+		return editClearScreen, ""
+	case "ctrl+x":
+		s.ctrlX = true
+	}
+
+	return editContinue, ""
+}
+
+func (s *editState) insert(r rune) {
+	s.buf = append(s.buf[:s.pos], append([]rune{r}, s.buf[s.pos:]...)...)
+	s.pos++
+}
+
+// Delete the text from start up to end, clamped to the message
+func (s *editState) delete(start int, end int) {
+	if start < 0 {
+		start = 0
+	}
+	if end > len(s.buf) {
+		end = len(s.buf)
+	}
+	if start >= end {
+		return
+	}
+
+	s.buf = append(s.buf[:start], s.buf[end:]...)
+	s.pos = start
+}
+
+func (s *editState) moveTo(pos int) {
+	if pos >= 0 && pos <= len(s.buf) {
+		s.pos = pos
+	}
+}
+
+// Where the line the cursor is on starts and ends
+func (s *editState) lineStart() int {
+	i := s.pos
+	for i > 0 && s.buf[i-1] != '\n' {
+		i--
+	}
+	return i
+}
+
+func (s *editState) lineEnd() int {
+	i := s.pos
+	for i < len(s.buf) && s.buf[i] != '\n' {
+		i++
+	}
+	return i
+}
+
+// Move the cursor up or down a line, keeping its column where it can
+func (s *editState) moveLine(step int) {
+	column := s.pos - s.lineStart()
+
+	// Go to the end of the line above, then its start, or the start of the
+	// line below
+	if step < 0 {
+		s.pos = s.lineStart() - 1
+		s.pos = s.lineStart()
+	} else {
+		s.pos = s.lineEnd() + 1
+	}
+
+	if length := s.lineEnd() - s.pos; column > length {
+		column = length
+	}
+
+	s.pos += column
+}
+
+// The start of the word before the cursor, and the end of the one after it
+func (s *editState) wordLeft() int {
+	i := s.pos
+	for i > 0 && !isWordRune(s.buf[i-1]) {
+		i--
+	}
+	for i > 0 && isWordRune(s.buf[i-1]) {
+		i--
+	}
+	return i
+}
+
+func (s *editState) wordRight() int {
+	i := s.pos
+	for i < len(s.buf) && !isWordRune(s.buf[i]) {
+		i++
+	}
+	for i < len(s.buf) && isWordRune(s.buf[i]) {
+		i++
+	}
+	return i
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
+
+// Go back or forward through the history, keeping what was being typed
+func (s *editState) historyMove(step int) {
+	next := s.historyPos + step
+	if next < 0 || next > len(s.history) {
+		return
+	}
+
+	if s.historyPos == len(s.history) {
+		s.draft = s.buf
+	}
+
+	s.historyPos = next
+
+	if next == len(s.history) {
+		s.buf = s.draft
+	} else {
+		s.buf = []rune(s.history[next])
+	}
+
+	s.pos = len(s.buf)
+}
+
+// Whether Enter sends the message, and the message it sends. A message that
+// starts with <<EOF is only done on a line with just EOF
+func (s *editState) submit() (string, bool) {
+	text := string(s.buf)
+	lines := strings.Split(text, "\n")
+
+	delimiter, ok := heredocDelimiter(lines[0])
+	if !ok {
+		return text, true
+	}
+
+	if len(lines) > 1 && s.pos == len(s.buf) && lines[len(lines)-1] == delimiter {
+		return strings.Join(lines[1:len(lines)-1], "\n"), true
+	}
+
+	return "", false
+}
+
+/////////////////
+
+// What to print to draw the prompt and the message at the given width, and
+// the rows the cursor and the end of the message land on. Long lines are
+// wrapped here, so we always know which row the cursor is on
+func (s *editState) layout(width int) (string, int, int) {
+	var out strings.Builder
+
+	// Back to the start of the prompt, and clear everything below it
+	if s.cursorRow > 0 {
+		fmt.Fprintf(&out, "\x1b[%dA", s.cursorRow)
+	}
+	out.WriteString("\r\x1b[J")
+	out.WriteString(s.prompt)
+
+	indent := strings.Repeat(" ", s.promptWidth)
+	row, col := 0, s.promptWidth
+	cursorRow, cursorCol := 0, col
+
+	for i := 0; i <= len(s.buf); i++ {
+		if i == len(s.buf) {
+			if col >= width {
+				out.WriteString("\r\n")
+				row, col = row+1, 0
+			}
+
+			if i == s.pos {
+				cursorRow, cursorCol = row, col
+			}
+			break
+		}
+
+		r := s.buf[i]
+
+		if r == '\n' {
+			if i == s.pos {
+				cursorRow, cursorCol = row, col
+			}
+
+			out.WriteString("\r\n" + indent)
+			row, col = row+1, s.promptWidth
+			continue
+		}
+
+		text, w := string(r), runewidth.RuneWidth(r)
+		if r == '\t' {
+			text, w = "    ", 4
+		} else if r < 0x20 {
+			text, w = "", 0
+		}
+
+		if col+w > width {
+			out.WriteString("\r\n")
+			row, col = row+1, 0
+		}
+
+		if i == s.pos {
+			cursorRow, cursorCol = row, col
+		}
+
+		out.WriteString(text)
+		col += w
+	}
+
+	// From the end of the message to the cursor
+	if row > cursorRow {
+		fmt.Fprintf(&out, "\x1b[%dA", row-cursorRow)
+	}
+	out.WriteString("\r")
+	if cursorCol > 0 {
+		fmt.Fprintf(&out, "\x1b[%dC", cursorCol)
+	}
+
+	return out.String(), cursorRow, row
+}
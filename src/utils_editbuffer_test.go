@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEditorKey(t *testing.T) {
+	tests := []struct {
+		input string
+		key   editorKey
+		rest  string
+		ok    bool
+	}{
+		{"a", editorKey{r: 'a'}, "", true},
+		{"éa", editorKey{r: 'é'}, "a", true},
+		{"\xc3", editorKey{}, "\xc3", false}, // Half a character
+		{"\r", editorKey{name: "enter"}, "", true},
+		{"\n", editorKey{name: "ctrl+j"}, "", true},
+		{"\t", editorKey{name: "tab"}, "", true},
+		{"\x7f", editorKey{name: "backspace"}, "", true},
+		{"\x01", editorKey{name: "ctrl+a"}, "", true},
+		{"\x18\x05", editorKey{name: "ctrl+x"}, "\x05", true},
+		{"\x1b[A", editorKey{name: "up"}, "", true},
+		{"\x1b[1;5Cx", editorKey{name: "word-right"}, "x", true},
+		{"\x1b[3~", editorKey{name: "delete"}, "", true},
+		{"\x1b[200~hi", editorKey{name: "paste-start"}, "hi", true},
+		{"\x1b[1;5", editorKey{}, "\x1b[1;5", false}, // Half a sequence
+		{"\x1b", editorKey{}, "\x1b", false},
+		{"\x1bOH", editorKey{name: "home"}, "", true},
+		{"\x1b\r", editorKey{name: "alt+enter"}, "", true},
+		{"\x1bb", editorKey{name: "word-left"}, "", true},
+		{"\x1b\x7f", editorKey{name: "alt+backspace"}, "", true},
+		{"\x1b[13;2u", editorKey{name: "alt+enter"}, "", true},
+		{"\x1b[99~", editorKey{name: ""}, "", true}, // Unknown sequences are swallowed whole
+	}
+
+	for _, tt := range tests {
+		key, rest, ok := parseEditorKey([]byte(tt.input))
+
+		if ok != tt.ok || key != tt.key || string(rest) != tt.rest {
+			t.Errorf("parseEditorKey(%q) = %+v, %q, %v, want %+v, %q, %v", tt.input, key, rest, ok, tt.key, tt.rest, tt.ok)
+		}
+	}
+}
+
+// Send input to the state the way the line editor does. Returns the first
+// action that is not editContinue
+func typeKeys(t *testing.T, s *editState, input string) (editAction, string) {
+	pending := []byte(input)
+
+	for len(pending) > 0 {
+		key, rest, ok := parseEditorKey(pending)
+		if !ok {
+			t.Fatalf("%q ends in the middle of a key", input)
+		}
+		pending = rest
+
+		if action, text := s.apply(key); action != editContinue {
+			return action, text
+		}
+	}
+
+	return editContinue, ""
+}
+
+func TestEditStateApply(t *testing.T) {
+	left, up, down := "\x1b[D", "\x1b[A", "\x1b[B"
+
+	tests := []struct {
+		name   string
+		input  string
+		action editAction
+		sent   string
+		buf    string // What is left to edit when nothing was sent
+		pos    int
+	}{
+		{"typing", "hello", editContinue, "", "hello", 5},
+		{"enter sends", "hello\r", editSend, "hello", "", 0},
+		{"insert in the middle", "hllo" + left + left + left + "e", editContinue, "", "hello", 2},
+		{"backspace", "helloo\x7f", editContinue, "", "hello", 5},
+		{"ctrl+w deletes a word", "hello world\x17", editContinue, "", "hello ", 6},
+		{"ctrl+u deletes to the line start", "one\ntwo\x15", editContinue, "", "one\n", 4},
+		{"ctrl+k at the end of a line joins", "ab\ncd" + up + "\x05\x0b", editContinue, "", "abcd", 2},
+		{"alt+enter starts a line", "one\x1b\rtwo\r", editSend, "one\ntwo", "", 0},
+		{"ctrl+j starts a line", "one\ntwo\r", editSend, "one\ntwo", "", 0},
+		{"heredoc waits for its end", "<<EOF\rline one\rline two\r", editContinue, "", "<<EOF\nline one\nline two\n", 24},
+		{"heredoc ends on its delimiter", "<<EOF\rline one\rEOF\r", editSend, "line one", "", 0},
+		{"paste keeps new lines", "\x1b[200~a\r\nb\rc\x1b[201~\r", editSend, "a\nb\nc", "", 0},
+		{"paste does not send", "\x1b[200~a\r\x1b[201~", editContinue, "", "a\n", 2},
+		{"ctrl+c on nothing", "\x03", editCancel, "", "", 0},
+		{"ctrl+c with text", "oops\x03", editDiscard, "", "oops", 4},
+		{"ctrl+d on nothing", "\x04", editEOF, "", "", 0},
+		{"ctrl+d deletes", "ab\x01\x04", editContinue, "", "b", 0},
+		{"ctrl+l", "\x0c", editClearScreen, "", "", 0},
+		{"ctrl+x ctrl+e", "draft\x18\x05", editOpenEditor, "", "draft", 5},
+		{"ctrl+e alone goes to the end", "draft\x01\x05", editContinue, "", "draft", 5},
+		{"up keeps the column", "abcdef\nxy" + left + up, editContinue, "", "abcdef\nxy", 1},
+		{"up to a shorter line", "ab\nxyzw" + up, editContinue, "", "ab\nxyzw", 2},
+		{"down keeps the column", "abc\nxyz\x1b[A\x01\x1b[C" + down, editContinue, "", "abc\nxyz", 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newEditState("> ", nil)
+
+			action, sent := typeKeys(t, s, tt.input)
+
+			if action != tt.action || sent != tt.sent {
+				t.Fatalf("got action %d sending %q, want %d sending %q", action, sent, tt.action, tt.sent)
+			}
+
+			if action == editSend {
+				return
+			}
+
+			if string(s.buf) != tt.buf || s.pos != tt.pos {
+				t.Errorf("buffer %q at %d, want %q at %d", string(s.buf), s.pos, tt.buf, tt.pos)
+			}
+		})
+	}
+}
+
+func TestEditStateHistory(t *testing.T) {
+	up, down := "\x1b[A", "\x1b[B"
+
+	s := newEditState("> ", []string{"first", "second\nlines"})
+	typeKeys(t, s, "draft")
+
+	steps := []struct {
+		keys string
+		buf  string
+	}{
+		{up, "second\nlines"},
+		{up, "second\nlines"}, // On its last line, up goes to the line above first
+		{up, "first"},
+		{up, "first"},           // Nothing older
+		{down, "second\nlines"}, // The cursor ends up at the end, on the last line
+		{down, "draft"},         // Back to what was being typed
+		{down, "draft"},
+	}
+
+	for i, step := range steps {
+		typeKeys(t, s, step.keys)
+
+		if string(s.buf) != step.buf {
+			t.Fatalf("step %d: buffer %q, want %q", i+1, string(s.buf), step.buf)
+		}
+	}
+}
+
+func TestEditStateLayout(t *testing.T) {
+	tests := []struct {
+		name      string
+		buf       string
+		pos       int
+		width     int
+		cursorRow int
+		endRow    int
+	}{
+		{"one line", "hello", 5, 80, 0, 0},
+		{"two lines", "hello\nworld", 11, 80, 1, 1},
+		{"cursor on the first of two", "hello\nworld", 2, 80, 0, 1},
+		{"wraps", strings.Repeat("x", 20), 20, 10, 2, 2},
+		{"wide characters wrap whole", "日本語日本語", 0, 10, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newEditState("> ", nil)
+			s.buf, s.pos = []rune(tt.buf), tt.pos
+
+			out, cursorRow, endRow := s.layout(tt.width)
+
+			if cursorRow != tt.cursorRow || endRow != tt.endRow {
+				t.Errorf("cursor row %d, end row %d, want %d and %d", cursorRow, endRow, tt.cursorRow, tt.endRow)
+			}
+
+			if !strings.HasPrefix(out, "\r\x1b[J> ") {
+				t.Errorf("output %q does not start by clearing and drawing the prompt", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+/////////////////
+
+// thyme export turns a history file into a document to paste elsewhere:
+// Markdown, a standalone HTML page or plain JSON. Chats export the branch
+// that was used last
+
+// A conversation as it is exported
+type transcript struct {
+	Title string           `json:"title"`
+	File  string           `json:"file"`
+	Turns []transcriptTurn `json:"turns"`
+}
+
+type transcriptTurn struct {
+	Query  string   `json:"query"`
+	Answer string   `json:"answer"`
+	Model  string   `json:"model,omitempty"`
+	System string   `json:"system,omitempty"`
+	Files  []string `json:"files,omitempty"`
+}
+
+// The formats thyme export can write
+var exportFormats = []string{"md", "html", "json"}
+
+// Run thyme export with the arguments after it. Returns the exit code
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("thyme export", flag.ExitOnError)
+	formatFlag := flags.String("format", "md", "What to export to: md, html or json.")
+	outputFlag := flags.String("o", "", "The file to write to. Defaults to stdout.")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: thyme export <history file> [flags]\n\nFlags:\n")
+		flags.PrintDefaults()
+	}
+
+	// The flags can come before or after the file
+	flags.Parse(args)
+	files := []string{}
+	for flags.NArg() > 0 {
+		files = append(files, flags.Arg(0))
+		flags.Parse(flags.Args()[1:])
+	}
+
+	if len(files) != 1 {
+		flags.Usage()
+		return 1
+	}
+
+	t, err := loadTranscript(files[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read the history file:", err)
+		return 1
+	}
+
+	var out string
+
+	switch *formatFlag {
+	case "md", "markdown":
+		out = exportMarkdown(t)
+	case "html":
+		out, err = exportHTML(t)
+	case "json":
+		var data []byte
+		data, err = json.MarshalIndent(t, "", "  ")
+		out = string(data) + "\n"
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown format %s, use %s.\n", *formatFlag, strings.Join(exportFormats, ", "))
+		return 1
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not export the history file:", err)
+		return 1
+	}
+
+	if *outputFlag == "" {
+		fmt.Print(out)
+		return 0
+	}
+
+	if err := ioutil.WriteFile(*outputFlag, []byte(out), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, "Could not write the export:", err)
+		return 1
+	}
+
+	return 0
+}
+
+// Read a chat, query, summary or chain history file. Only chats have more
+// than one turn
+func loadTranscript(filename string) (transcript, error) {
+	t := transcript{Title: transcriptTitle(filename), File: filename}
+
+	if strings.HasSuffix(filename, ".jsonl") {
+		history, err := readChatHistoryFile(filename)
+		if err != nil {
+			return t, err
+		}
+
+		for _, line := range activeChatBranch(history.ChatHistoryLines) {
+			t.Turns = append(t.Turns, transcriptTurn{
+				Query:  line.Query,
+				Answer: line.Answer,
+				Model:  line.Model,
+				System: line.System,
+				Files:  line.Files,
+			})
+		}
+
+		return t, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return t, err
+	}
+
+	// Queries, summaries and chains all save a query and an answer
+	var saved QueryHistory
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return t, err
+	}
+
+	t.Turns = []transcriptTurn{{Query: saved.Query, Answer: saved.Answer}}
+
+	return t, nil
+}
+
+// A title from the history file's name: 2023-08-14-16-02-11-chat.jsonl
+// becomes "Chat, 2023-08-14 16:02:11"
+func transcriptTitle(filename string) string {
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+
+	stamped := regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-(\d{2})-(\d{2})-(\d{2})-(\w+)$`)
+	if m := stamped.FindStringSubmatch(name); m != nil {
+		return fmt.Sprintf("%s%s, %s %s:%s:%s", strings.ToUpper(m[5][:1]), m[5][1:], m[1], m[2], m[3], m[4])
+	}
+
+	return name
+}
+
+/////////////////
+
+// The transcript in Markdown. Every code block is fenced with its language
+func exportMarkdown(t transcript) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", t.Title)
+
+	system := ""
+	for i, turn := range t.Turns {
+		if turn.System != system {
+			system = turn.System
+			fmt.Fprintf(&b, "> **System:** %s\n\n", strings.ReplaceAll(system, "\n", "\n> "))
+		}
+
+		if len(t.Turns) > 1 {
+			fmt.Fprintf(&b, "## Turn %d\n\n", i+1)
+		}
+
+		fmt.Fprintf(&b, "**You:**\n\n%s\n\n", fenceCodeLanguages(turn.Query))
+
+		speaker := "Assistant"
+		if turn.Model != "" {
+			speaker = turn.Model
+		}
+
+		fmt.Fprintf(&b, "**%s:**\n\n%s\n\n", speaker, fenceCodeLanguages(turn.Answer))
+	}
+
+	return strings.TrimRight(b.String(), "\n") + "\n"
+}
+
+// Fence lines open and close code blocks: ``` or ~~~, and the language
+var fenceLine = regexp.MustCompile("^(\\s*)(```+|~~~+)\\s*([^`\\s]*)")
+
+// Give code blocks without a language the one they look like, so they are
+// highlighted wherever the Markdown ends up. Blocks that are never closed
+// are closed at the end
+func fenceCodeLanguages(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+
+	out := []string{}
+	open := -1 // The line of the open fence in out
+	fence := ""
+
+	for _, line := range lines {
+		m := fenceLine.FindStringSubmatch(line)
+
+		if open < 0 {
+			if m != nil {
+				open, fence = len(out), m[2]
+			}
+
+			out = append(out, line)
+			continue
+		}
+
+		// Only a fence as long as the opening one, with nothing after it,
+		// closes the block
+		if m != nil && strings.HasPrefix(m[2], fence) && m[3] == "" {
+			out[open] = labelFence(out[open], strings.Join(out[open+1:], "\n"))
+			open = -1
+		}
+
+		out = append(out, line)
+	}
+
+	if open >= 0 {
+		out[open] = labelFence(out[open], strings.Join(out[open+1:], "\n"))
+		out = append(out, fence)
+	}
+
+	return strings.Join(out, "\n")
+}
+
+// An opening fence with the code's language, when it has none
+func labelFence(line string, code string) string {
+	m := fenceLine.FindStringSubmatch(line)
+	if m[3] != "" {
+		return line
+	}
+
+	language := detectProgrammingLanguageEnry(code)
+	if language == "" || language == "text" {
+		return line
+	}
+
+	return m[1] + m[2] + language
+}
+
+/////////////////
+
+// The transcript as a single HTML page, with its styles inline and the code
+// highlighted, so it can be opened or attached anywhere
+func exportHTML(t transcript) (string, error) {
+	markdown := goldmark.New(
+		goldmark.WithExtensions(extension.GFM),
+		goldmark.WithRendererOptions(
+			renderer.WithNodeRenderers(util.Prioritized(codeBlockRenderer{}, 100)),
+		),
+	)
+
+	render := func(text string) (string, error) {
+		var buf bytes.Buffer
+		err := markdown.Convert([]byte(fenceCodeLanguages(text)), &buf)
+		return buf.String(), err
+	}
+
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html lang=\"en\">\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n<style>%s</style>\n</head>\n<body>\n<main>\n", html.EscapeString(t.Title), exportCSS)
+	fmt.Fprintf(&b, "<h1>%s</h1>\n", html.EscapeString(t.Title))
+
+	system := ""
+	for _, turn := range t.Turns {
+		if turn.System != system {
+			system = turn.System
+			fmt.Fprintf(&b, "<section class=\"system\"><h2>System</h2>\n<p>%s</p>\n</section>\n", html.EscapeString(system))
+		}
+
+		query, err := render(turn.Query)
+		if err != nil {
+			return "", err
+		}
+
+		answer, err := render(turn.Answer)
+		if err != nil {
+			return "", err
+		}
+
+		speaker := "Assistant"
+		if turn.Model != "" {
+			speaker = turn.Model
+		}
+
+		fmt.Fprintf(&b, "<section class=\"user\"><h2>You</h2>\n%s</section>\n", query)
+		fmt.Fprintf(&b, "<section class=\"assistant\"><h2>%s</h2>\n%s</section>\n", html.EscapeString(speaker), answer)
+	}
+
+	b.WriteString("</main>\n</body>\n</html>\n")
+
+	return b.String(), nil
+}
+
+const exportCSS = `
+body { margin: 0; background: #f6f8fa; color: #1f2328; font: 16px/1.5 -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; }
+main { max-width: 860px; margin: 0 auto; padding: 2em 1em; }
+h1 { font-size: 1.6em; }
+h2 { font-size: 0.85em; margin: 0 0 0.5em; text-transform: uppercase; letter-spacing: 0.05em; color: #59636e; }
+section { background: #fff; border: 1px solid #d1d9e0; border-radius: 8px; padding: 1em 1.25em; margin: 1em 0; }
+section.user { border-left: 4px solid #1FC3B7; }
+section.assistant { border-left: 4px solid #8de765; }
+section.system { border-left: 4px solid #E8B730; white-space: pre-wrap; }
+pre { padding: 0.75em 1em; border: 1px solid #d1d9e0; border-radius: 6px; overflow-x: auto; font-size: 0.875em; }
+code { font-family: ui-monospace, SFMono-Regular, Menlo, Consolas, monospace; }
+:not(pre) > code { background: #eff1f3; padding: 0.1em 0.3em; border-radius: 4px; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #d1d9e0; padding: 0.3em 0.6em; }
+`
+
+// Renders fenced code blocks with chroma, with the colors inline
+type codeBlockRenderer struct{}
+
+func (r codeBlockRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.render)
+}
+
+func (r codeBlockRenderer) render(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	block := node.(*ast.FencedCodeBlock)
+
+	var code strings.Builder
+	for i := 0; i < block.Lines().Len(); i++ {
+		segment := block.Lines().At(i)
+		code.Write(segment.Value(source))
+	}
+
+	lexer := lexers.Get(string(block.Language(source)))
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	style := styles.Get("github")
+	if style == nil {
+		style = styles.Fallback
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, code.String())
+	if err != nil {
+		return ast.WalkStop, err
+	}
+
+	formatter := chromahtml.New(chromahtml.TabWidth(4))
+	if err := formatter.Format(w, style, iterator); err != nil {
+		return ast.WalkStop, err
+	}
+
+	return ast.WalkSkipChildren, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFenceCodeLanguages(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{
+			name: "plain text",
+			text: "No code here.\n",
+			want: "No code here.",
+		},
+		{
+			name: "a block without a language",
+			text: "Run it:\n```\n#!/bin/bash\necho hi\n```",
+			want: "Run it:\n```shell\n#!/bin/bash\necho hi\n```",
+		},
+		{
+			name: "a block with a language",
+			text: "```python\n#!/bin/bash\necho hi\n```",
+			want: "```python\n#!/bin/bash\necho hi\n```",
+		},
+		{
+			name: "tildes and indentation",
+			text: "- In C:\n  ~~~\n  #include <stdio.h>\n  int main() { return 0; }\n  ~~~",
+			want: "- In C:\n  ~~~c\n  #include <stdio.h>\n  int main() { return 0; }\n  ~~~",
+		},
+		{
+			name: "code that does not look like a language",
+			text: "```\none two three\n```",
+			want: "```\none two three\n```",
+		},
+		{
+			name: "a shorter fence does not close the block",
+			text: "````markdown\n```\ninside\n```\n````",
+			want: "````markdown\n```\ninside\n```\n````",
+		},
+		{
+			name: "a fence with a language does not close the block",
+			text: "```text\na\n```go\nb\n```",
+			want: "```text\na\n```go\nb\n```",
+		},
+		{
+			name: "a block that is never closed",
+			text: "```c\n#include <stdio.h>",
+			want: "```c\n#include <stdio.h>\n```",
+		},
+		{
+			name: "the fence that closes an unclosed block matches it",
+			text: "~~~~text\nstill going",
+			want: "~~~~text\nstill going\n~~~~",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := fenceCodeLanguages(tt.text); got != tt.want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTranscriptTitle(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"/history/2023-08-14-16-02-11-chat.jsonl", "Chat, 2023-08-14 16:02:11"},
+		{"2023-08-14-16-02-11-summary.json", "Summary, 2023-08-14 16:02:11"},
+		{"notes.json", "notes"},
+	}
+
+	for _, tt := range tests {
+		if got := transcriptTitle(tt.filename); got != tt.want {
+			t.Errorf("transcriptTitle(%s) = %q, want %q", tt.filename, got, tt.want)
+		}
+	}
+}
+
+// Two turns of a chat, the system prompt changing between them
+func testTranscript() transcript {
+	return transcript{
+		Title: "Chat <&> notes",
+		Turns: []transcriptTurn{
+			{Query: "Say hi", Answer: "Hi!", Model: "gpt-4", System: "Be brief."},
+			{Query: "And <script>alert(1)</script>?", Answer: "```\n#include <stdio.h>\nint main() { return 0; }\n```", System: "Be <terse>."},
+		},
+	}
+}
+
+func TestExportMarkdown(t *testing.T) {
+	got := exportMarkdown(testTranscript())
+
+	for _, want := range []string{
+		"# Chat <&> notes\n",
+		"> **System:** Be brief.\n",
+		"## Turn 1\n",
+		"**gpt-4:**\n\nHi!",
+		"> **System:** Be <terse>.\n",
+		"**Assistant:**\n\n```c\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("the Markdown is missing %q:\n%s", want, got)
+		}
+	}
+
+	// A single turn needs no headings
+	single := transcript{Title: "Query", Turns: []transcriptTurn{{Query: "q", Answer: "a"}}}
+	if got := exportMarkdown(single); strings.Contains(got, "## Turn") {
+		t.Errorf("a single turn has a heading:\n%s", got)
+	}
+}
+
+func TestExportHTML(t *testing.T) {
+	got, err := exportHTML(testTranscript())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"the title is escaped", "<title>Chat &lt;&amp;&gt; notes</title>"},
+		{"the heading is escaped", "<h1>Chat &lt;&amp;&gt; notes</h1>"},
+		{"the system prompt", `<section class="system"><h2>System</h2>` + "\n<p>Be brief.</p>"},
+		{"a changed system prompt is escaped", "<p>Be &lt;terse&gt;.</p>"},
+		{"the model answers", `<section class="assistant"><h2>gpt-4</h2>`},
+		{"a turn without a model", `<section class="assistant"><h2>Assistant</h2>`},
+		{"code is highlighted inline", `<span style="color:#458;font-weight:bold">int</span>`},
+		{"raw HTML is left out", "<!-- raw HTML omitted -->"},
+	}
+
+	for _, tt := range tests {
+		if !strings.Contains(got, tt.want) {
+			t.Errorf("%s: the page is missing %q", tt.name, tt.want)
+		}
+	}
+
+	if strings.Contains(got, "<script>") {
+		t.Errorf("the page runs a script from the chat:\n%s", got)
+	}
+}
+
+func TestLoadTranscript(t *testing.T) {
+	dir := t.TempDir()
+
+	// A chat exports the branch used last
+	chat := filepath.Join(dir, "2023-08-14-16-02-11-chat.jsonl")
+	session := &ChatSession{File: chat, Model: "gpt-4"}
+	session.addTurn("first", ChatHistoryLine{Query: "first", Answer: "one", Model: "gpt-4"})
+	session.addTurn("second", ChatHistoryLine{Query: "second", Answer: "two", Model: "gpt-4"})
+	session.checkout(1)
+	session.addTurn("second, edited", ChatHistoryLine{Query: "second, edited", Answer: "two again", Model: "gpt-4"})
+
+	loaded, err := loadTranscript(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Title != "Chat, 2023-08-14 16:02:11" || len(loaded.Turns) != 2 || loaded.Turns[1].Query != "second, edited" {
+		t.Errorf("chat transcript = %+v, want the edited branch", loaded)
+	}
+
+	// Other history files are one turn
+	query := filepath.Join(dir, "2023-08-14-16-02-11-query.json")
+	if err := os.WriteFile(query, []byte(`{"query": "q", "answer": "a"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err = loadTranscript(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded.Turns) != 1 || loaded.Turns[0].Query != "q" || loaded.Turns[0].Answer != "a" {
+		t.Errorf("query transcript = %+v", loaded)
+	}
+}
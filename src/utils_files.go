@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-enry/go-enry/v2"
+	ignore "github.com/sabhiram/go-gitignore"
+)
+
+/////////////////
+
+// The files a chat is about, from the paths, globs and directories given to
+// -chat -file. Directories are read all the way down, leaving out what
+// .gitignore ignores. Binary files are skipped and returned apart
+func collectChatFiles(args []string) ([]string, []string, error) {
+	files := []string{}
+	skipped := []string{}
+	seen := map[string]bool{}
+
+	add := func(path string) error {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+
+		if seen[abs] {
+			return nil
+		}
+		seen[abs] = true
+
+		binary, err := isBinaryFile(path)
+		if err != nil {
+			return err
+		}
+
+		if binary {
+			skipped = append(skipped, path)
+		} else {
+			files = append(files, path)
+		}
+
+		return nil
+	}
+
+	for _, arg := range args {
+		paths := []string{arg}
+
+		// Globs the shell did not expand, because they were quoted
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s is not a valid glob: %w", arg, err)
+			}
+
+			if len(matches) == 0 {
+				return nil, nil, fmt.Errorf("no files match %s", arg)
+			}
+
+			paths = matches
+		}
+
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if !info.IsDir() {
+				if err := add(path); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			found, err := walkChatDirectory(path)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for _, file := range found {
+				if err := add(file); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, skipped, fmt.Errorf("there are no text files in %s", strings.Join(args, ", "))
+	}
+
+	return files, skipped, nil
+}
+
+// Every file under a directory that git would not ignore
+func walkChatDirectory(root string) ([]string, error) {
+	rules, err := newGitignoreRules(root)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+
+	err = filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == root {
+			return nil
+		}
+
+		if entry.IsDir() && entry.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		if rules.ignored(path, entry.IsDir()) {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if entry.Type().IsRegular() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+
+	return files, err
+}
+
+// Whether a file looks binary, going by its first few kilobytes
+func isBinaryFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 8000)
+	n, err := file.Read(head)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	return enry.IsBinary(head[:n]), nil
+}
+
+/////////////////
+
+// The .gitignore files that apply under a directory. Like git, the ones in
+// the directories above it count too, up to the top of the repository
+type gitignoreRules struct {
+	top   string
+	rules map[string]*ignore.GitIgnore
+}
+
+func newGitignoreRules(root string) (*gitignoreRules, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	// Outside a repository only the directory's own .gitignore files count
+	top := abs
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			top = dir
+			break
+		}
+
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	return &gitignoreRules{top: top, rules: map[string]*ignore.GitIgnore{}}, nil
+}
+
+// The rules of one directory's .gitignore, nil when it has none
+func (g *gitignoreRules) load(dir string) *ignore.GitIgnore {
+	if rules, ok := g.rules[dir]; ok {
+		return rules
+	}
+
+	rules, err := ignore.CompileIgnoreFile(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		rules = nil
+	}
+
+	g.rules[dir] = rules
+	return rules
+}
+
+// Whether a .gitignore from the path's directory up to the top ignores it
+func (g *gitignoreRules) ignored(path string, isDir bool) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	for dir := filepath.Dir(abs); ; dir = filepath.Dir(dir) {
+		if rules := g.load(dir); rules != nil {
+			rel, err := filepath.Rel(dir, abs)
+			if err == nil {
+				rel = filepath.ToSlash(rel)
+
+				// Patterns ending in / only match directories
+				if isDir {
+					rel += "/"
+				}
+
+				if rules.MatchesPath(rel) {
+					return true
+				}
+			}
+		}
+
+		if dir == g.top || dir == filepath.Dir(dir) {
+			return false
+		}
+	}
+}
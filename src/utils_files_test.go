@@ -0,0 +1,181 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A small repository: .gitignore files at the top and in src, a binary
+// image, and the .git directory itself
+func writeTestRepository(t *testing.T) string {
+	root := t.TempDir()
+
+	files := map[string]string{
+		".git/config":        "[core]\n",
+		".gitignore":         "*.log\nbuild/\n",
+		"README.md":          "# Test\n",
+		"image.png":          "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01",
+		"build/out.go":       "package build\n",
+		"src/.gitignore":     "secret.txt\n",
+		"src/main.go":        "package main\n",
+		"src/secret.txt":     "hunter2\n",
+		"src/app.log":        "started\n",
+		"src/nested/util.go": "package nested\n",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(root, name)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return root
+}
+
+func TestCollectChatFiles(t *testing.T) {
+	root := writeTestRepository(t)
+	at := func(names ...string) []string {
+		paths := []string{}
+		for _, name := range names {
+			paths = append(paths, filepath.Join(root, name))
+		}
+		return paths
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		files   []string
+		skipped []string
+		err     string
+	}{
+		{
+			name:    "the whole repository",
+			args:    at("."),
+			files:   at(".gitignore", "README.md", "src/.gitignore", "src/main.go", "src/nested/util.go"),
+			skipped: at("image.png"),
+		},
+		{
+			name:  "a directory inside it keeps the rules above",
+			args:  at("src"),
+			files: at("src/.gitignore", "src/main.go", "src/nested/util.go"),
+		},
+		{
+			name:  "files given by name are sent even when ignored",
+			args:  at("src/app.log"),
+			files: at("src/app.log"),
+		},
+		{
+			name:  "globs",
+			args:  []string{filepath.Join(root, "src", "*.go")},
+			files: at("src/main.go"),
+		},
+		{
+			name:  "every file once",
+			args:  at("src/main.go", "src", "src/main.go"),
+			files: at("src/main.go", "src/.gitignore", "src/nested/util.go"),
+		},
+		{
+			name: "a glob without matches",
+			args: []string{filepath.Join(root, "*.rs")},
+			err:  "no files match",
+		},
+		{
+			name: "only binary files",
+			args: at("image.png"),
+			err:  "there are no text files",
+		},
+		{
+			name: "a missing file",
+			args: at("missing.go"),
+			err:  "no such file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, skipped, err := collectChatFiles(tt.args)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want one mentioning %q", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("collecting failed: %v", err)
+			}
+
+			// Walked directories come in WalkDir's order, compare as sets
+			for _, list := range [][]string{files, skipped, tt.files, tt.skipped} {
+				for i := range list {
+					list[i] = filepath.Clean(list[i])
+				}
+				sort.Strings(list)
+			}
+
+			if !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("files = %q, want %q", files, tt.files)
+			}
+
+			if len(skipped)+len(tt.skipped) > 0 && !reflect.DeepEqual(skipped, tt.skipped) {
+				t.Errorf("skipped = %q, want %q", skipped, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestGitignoreRules(t *testing.T) {
+	root := writeTestRepository(t)
+
+	rules, err := newGitignoreRules(filepath.Join(root, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rules.top != root {
+		t.Errorf("top = %s, want the repository at %s", rules.top, root)
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"src/main.go", false, false},
+		{"src/app.log", false, true},    // *.log from the top
+		{"src/secret.txt", false, true}, // From src/.gitignore
+		{"secret.txt", false, false},    // src's rules stay in src
+		{"build", true, true},
+		{"build", false, false}, // build/ only matches directories
+		{"src/nested/util.go", false, false},
+	}
+
+	for _, tt := range tests {
+		if got := rules.ignored(filepath.Join(root, tt.path), tt.isDir); got != tt.ignored {
+			t.Errorf("ignored(%s, dir %v) = %v, want %v", tt.path, tt.isDir, got, tt.ignored)
+		}
+	}
+}
+
+func TestChatHistoryLineFiles(t *testing.T) {
+	root := writeTestRepository(t)
+	kept := filepath.Join(root, "README.md")
+
+	line := ChatHistoryLine{Files: []string{kept, filepath.Join(root, "deleted.go")}}
+
+	if files := line.chatFiles(); !reflect.DeepEqual(files, []string{kept}) {
+		t.Errorf("chatFiles = %q, want only the file that is still there", files)
+	}
+}
@@ -13,9 +13,17 @@ import (
 /////////////
 /////////////
 
+// One chat turn. ID and Parent place it in the tree of turns, see
+// utils_chattree.go. Model and System are what the turn was sent with, Files
+// the files that were sent when the query was about them
 type ChatHistoryLine struct {
-	Query  string `json:"query"`
-	Answer string `json:"answer"`
+	ID     int      `json:"id,omitempty"`
+	Parent int      `json:"parent,omitempty"`
+	Query  string   `json:"query"`
+	Answer string   `json:"answer"`
+	Model  string   `json:"model,omitempty"`
+	System string   `json:"system,omitempty"`
+	Files  []string `json:"files,omitempty"`
 }
 
 type QueryHistory struct {
@@ -62,8 +70,37 @@ func viewHistoryQueries(historyFlag string) {
 		if strings.Contains(historyFlag, "chat") {
 			queryHistory := loadChatHistoryFile(historyFlag)
 
-			chl := queryHistory.ChatHistoryLines
+			// Show the branch that was used last, and where others fork
+			turns := numberChatTurns(queryHistory.ChatHistoryLines)
+			chl := activeChatBranch(queryHistory.ChatHistoryLines)
+
+			if len(chl) > 0 {
+				if ends := chatBranchEnds(turns, chl[len(chl)-1].ID); len(ends) > 1 {
+					fmt.Println(styles.historyInfo.Render(fmt.Sprintf("This chat has %d branches, showing the one used last. -chat -resume and /branches switch between them.", len(ends))))
+					fmt.Println()
+				}
+			}
+
+			system := ""
 			for i := range chl {
+				if versions := chatChildren(turns, chl[i].Parent); len(versions) > 1 {
+					for v := range versions {
+						if versions[v].ID == chl[i].ID {
+							fmt.Println(styles.historyInfo.Render(fmt.Sprintf("Fork: version %d of %d of turn %d", v+1, len(versions), i+1)))
+						}
+					}
+				}
+
+				// Show the system prompt where the chat starts with it, or
+				// where /system changed it
+				if chl[i].System != system {
+					system = chl[i].System
+					fmt.Println(styles.historyTitle.Render("System: "))
+					fmt.Println(styles.historyTitle.Render("----------"))
+					fmt.Println(system)
+					fmt.Println()
+				}
+
 				fmt.Println(styles.historyTitle.Render("Query: "))
 				fmt.Println(styles.historyTitle.Render("----------"))
 				fmt.Println(chl[i].Query)
@@ -79,6 +116,27 @@ func viewHistoryQueries(historyFlag string) {
 
 		}
 
+		if strings.Contains(historyFlag, "chain") {
+			chainHistory := loadChainHistoryFile(historyFlag)
+			fmt.Println(styles.historyTitle.Render("Input: "))
+			fmt.Println(styles.historyTitle.Render("----------"))
+			fmt.Println(chainHistory.Query)
+			fmt.Println()
+
+			for _, step := range chainHistory.Steps {
+				fmt.Println(styles.historyTitle.Render(fmt.Sprintf("Step %d: %s (%s %s)", step.Step, step.Name, step.Provider, step.Model)))
+				fmt.Println(styles.historyTitle.Render("----------"))
+				fmt.Println(formatCodeBlocksInMarkdown(step.Output, ""))
+				fmt.Println()
+			}
+
+			if chainHistory.Error != "" {
+				fmt.Println(styles.historyTitle.Render("Failed: "))
+				fmt.Println(styles.historyTitle.Render("----------"))
+				fmt.Println(chainHistory.Error)
+			}
+		}
+
 		if strings.Contains(historyFlag, "summary") {
 			queryHistory := loadSummaryHistoryFile(historyFlag)
 			fmt.Println(styles.historyTitle.Render("Source: "))
@@ -147,17 +205,53 @@ func viewHistoryQueries(historyFlag string) {
 			if strings.Contains(fname, "chat") {
 
 				chat := loadChatHistoryFile(fname)
-				targetChat := chat.ChatHistoryLines[0]
+				branch := activeChatBranch(chat.ChatHistoryLines)
+				if len(branch) == 0 {
+					continue
+				}
+
+				targetChat := branch[0]
 				if len(targetChat.Query) > 75 {
 					targetChat.Query = targetChat.Query[:75]
 				}
 
 				fmt.Println(styles.historyInfo.Render("File: ") + styles.historyText.Render(fname))
+				if targetChat.System != "" {
+					fmt.Println(styles.historyInfo.Render("System: ") + styles.historyText.Render(truncateToWidth(targetChat.System, 75)))
+				}
 				fmt.Println(styles.historyInfo.Render("Starter: ") + styles.historyText.Render(targetChat.Query) + "\n")
 			}
 		}
 	}
 
+	if historyFlag == "chain" || historyFlag == "all" {
+
+		fmt.Println()
+		fmt.Println(styles.historyTitle.Render("Chains"))
+		fmt.Println(styles.historyTitle.Render("----------"))
+
+		// Load the chain files
+		for i := range historyFiles["openai"] {
+			fname := historyFiles["openai"][i]
+			if strings.Contains(fname, "chain") {
+				chainHistory := loadChainHistoryFile(fname)
+				// Cut by characters, a byte cut could split one
+				if runes := []rune(chainHistory.Query); len(runes) > 75 {
+					chainHistory.Query = string(runes[:75])
+				}
+
+				status := fmt.Sprintf("%d steps", len(chainHistory.Steps))
+				if chainHistory.Error != "" {
+					status += ", failed"
+				}
+
+				fmt.Println(styles.historyInfo.Render("File: ") + styles.historyText.Render(fname))
+				fmt.Println(styles.historyInfo.Render("Chain: ") + styles.historyText.Render(chainHistory.Chain+" ("+status+")"))
+				fmt.Println(styles.historyInfo.Render("Input: ") + styles.historyText.Render(chainHistory.Query) + "\n")
+			}
+		}
+	}
+
 	//fmt.Println(historyFiles)
 
 }
@@ -218,24 +312,53 @@ func loadSummaryHistoryFile(filename string) SummaryHistory {
 
 /////////////
 
+// Load a chain history file, and return a ChainSave object
+func loadChainHistoryFile(filename string) ChainSave {
+	filestr := readFileToString(filename)
+	chainHistory := ChainSave{}
+	json.Unmarshal([]byte(filestr), &chainHistory)
+	return chainHistory
+}
+
+/////////////
+
 // Load all ChatHitoryLines in a chat history file, and return a ChatHistory object
-// Cowritten by GPT-4
 func loadChatHistoryFile(filename string) ChatHistory {
+	chatHistory, err := readChatHistoryFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return chatHistory
+}
+
+// Read all ChatHitoryLines in a chat history file
+// Cowritten by GPT-4
+func readChatHistoryFile(filename string) (ChatHistory, error) {
 	chatHistory := ChatHistory{ChatHistoryLines: []ChatHistoryLine{}}
 
 	// Open the JSONL file
 	file, err := os.Open(filename)
 	if err != nil {
-		fmt.Printf("failed to open file: %s\n", err)
-		os.Exit(1)
+		return chatHistory, fmt.Errorf("failed to open file: %s", err)
 	}
 	defer file.Close()
 
 	// Read the file line-by-line and append each line into a string slice
+	// Long answers do not fit in the scanner's default 64KB lines
 	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
 	var lines []string
 	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+		if strings.TrimSpace(scanner.Text()) != "" {
+			lines = append(lines, scanner.Text())
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return chatHistory, fmt.Errorf("failed to read file: %s", err)
 	}
 
 	// Iterate through the slice, unmarshal each JSON object string and process it
@@ -243,14 +366,13 @@ func loadChatHistoryFile(filename string) ChatHistory {
 		var obj ChatHistoryLine
 		err := json.Unmarshal([]byte(lineJson), &obj)
 		if err != nil {
-			fmt.Printf("failed to unmarshal json: %s\n", err)
-			os.Exit(1)
+			return chatHistory, fmt.Errorf("failed to unmarshal json: %s", err)
 		}
 
 		chatHistory.ChatHistoryLines = append(chatHistory.ChatHistoryLines, obj)
 	}
 
-	return chatHistory
+	return chatHistory, nil
 }
 
 /////////////
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+/////////////
+
+// A small JSON Schema validator for checking structured answers locally.
+// It covers the keywords models are asked to follow in practice: type,
+// properties, required, additionalProperties, items, enum, const, the
+// length, size and range limits, multipleOf, pattern, the common formats,
+// anyOf, oneOf, allOf, not, and $ref to the schema's own definitions.
+// Schemas that use anything else are refused, so an answer is never
+// reported as valid against rules that were not checked
+
+// Parse a JSON schema file's contents, and check that we can validate
+// everything it asks for
+func parseJSONSchema(schema []byte) (map[string]any, error) {
+	var parsed map[string]any
+
+	if err := decodeJSONNumbers(schema, &parsed); err != nil {
+		return nil, fmt.Errorf("the schema is not valid JSON: %w", err)
+	}
+
+	if err := checkJSONSchema(parsed, parsed, "#"); err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+// Decode JSON keeping numbers as json.Number, so the document and the
+// schema compare them the same way
+func decodeJSONNumbers(data []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
+
+// Keywords that only describe a schema, they are fine to leave unchecked
+var jsonSchemaAnnotations = map[string]bool{
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+	"definitions": true, "$defs": true,
+}
+
+// Keywords the validator checks
+var jsonSchemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "$ref": true,
+	"properties": true, "required": true, "additionalProperties": true, "minProperties": true, "maxProperties": true,
+	"items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"minLength": true, "maxLength": true, "pattern": true, "format": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true,
+}
+
+// Refuse schemas with keywords, formats or references we cannot check. at is
+// where the schema sits in the root, for the messages
+func checkJSONSchema(schema map[string]any, root map[string]any, at string) error {
+	keys := make([]string, 0, len(schema))
+	for key := range schema {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if !jsonSchemaKeywords[key] && !jsonSchemaAnnotations[key] {
+			return fmt.Errorf("the schema uses %s at %s, which thyme cannot check", key, at)
+		}
+	}
+
+	if format, ok := schema["format"].(string); ok && jsonFormats[format] == nil {
+		return fmt.Errorf("the schema uses the %s format at %s, which thyme cannot check", format, at)
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		if _, err := resolveJSONSchemaRef(root, ref); err != nil {
+			return err
+		}
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("the pattern at %s is not a regular expression thyme understands: %w", at, err)
+		}
+	}
+
+	if _, ok := schema["items"].([]any); ok {
+		return fmt.Errorf("the schema gives items as a list at %s, which thyme cannot check", at)
+	}
+
+	// Then every schema inside this one
+	subschemas := map[string]any{}
+
+	for _, keyword := range []string{"properties", "definitions", "$defs"} {
+		if children, ok := schema[keyword].(map[string]any); ok {
+			for name, child := range children {
+				subschemas[at+"/"+keyword+"/"+name] = child
+			}
+		}
+	}
+
+	for _, keyword := range []string{"additionalProperties", "items", "not"} {
+		if child, ok := schema[keyword].(map[string]any); ok {
+			subschemas[at+"/"+keyword] = child
+		}
+	}
+
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		if children, ok := schema[keyword].([]any); ok {
+			for i, child := range children {
+				subschemas[fmt.Sprintf("%s/%s/%d", at, keyword, i)] = child
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(subschemas))
+	for path := range subschemas {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		if child, ok := subschemas[path].(map[string]any); ok {
+			if err := checkJSONSchema(child, root, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Find the schema a $ref points to. Only references into the schema itself
+// are supported: #, #/definitions/name, #/$defs/name and other JSON pointers
+func resolveJSONSchemaRef(root map[string]any, ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("the schema refers to %s, thyme can only follow references inside the schema", ref)
+	}
+
+	var current any = root
+
+	pointer := strings.TrimPrefix(ref, "#")
+	if pointer != "" {
+		for _, part := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+			part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+
+			object, ok := current.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("the schema's reference %s points nowhere", ref)
+			}
+
+			if current, ok = object[part]; !ok {
+				return nil, fmt.Errorf("the schema's reference %s points nowhere", ref)
+			}
+		}
+	}
+
+	schema, ok := current.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("the schema's reference %s is not a schema", ref)
+	}
+
+	return schema, nil
+}
+
+// Validate a JSON document against a schema. Returns a list of problems,
+// empty when the document is valid
+func validateJSONAgainstSchema(document []byte, schema map[string]any) []string {
+	var value any
+
+	if err := decodeJSONNumbers(document, &value); err != nil {
+		return []string{fmt.Sprintf("not valid JSON: %s", err)}
+	}
+
+	v := jsonSchemaValidator{root: schema}
+
+	return v.validate(value, schema, "$")
+}
+
+// Validates a document against the schema root, which $refs point into
+type jsonSchemaValidator struct {
+	root map[string]any
+}
+
+// How deep $refs may go. Recursive schemas are fine, a $ref that only ever
+// points at itself is not
+const jsonSchemaMaxRefs = 64
+
+/////////////
+
+// Validate one value against one (sub)schema. path is where the value
+// sits in the document, used in the messages
+func (v jsonSchemaValidator) validate(value any, schema map[string]any, path string) []string {
+	problems := []string{}
+
+	// A $ref stands for the schema it points to. The schema was checked
+	// when it was parsed, so the reference resolves
+	for refs := 0; ; refs++ {
+		ref, ok := schema["$ref"].(string)
+		if !ok {
+			break
+		}
+
+		if refs == jsonSchemaMaxRefs {
+			return append(problems, fmt.Sprintf("%s: the schema's references go round in circles", path))
+		}
+
+		resolved, err := resolveJSONSchemaRef(v.root, ref)
+		if err != nil {
+			return append(problems, fmt.Sprintf("%s: %s", path, err))
+		}
+
+		schema = resolved
+	}
+
+	if types, ok := schema["type"]; ok {
+		if !jsonTypeMatches(value, types) {
+			return append(problems, fmt.Sprintf("%s: expected %v, got %s", path, types, jsonTypeName(value)))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(value, option) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: must be one of %v", path, enum))
+		}
+	}
+
+	if constant, ok := schema["const"]; ok && !jsonEqual(value, constant) {
+		problems = append(problems, fmt.Sprintf("%s: must be %v", path, constant))
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		problems = append(problems, v.validateObject(value, schema, path)...)
+	case []any:
+		problems = append(problems, v.validateArray(value, schema, path)...)
+	case string:
+		problems = append(problems, validateJSONString(value, schema, path)...)
+	case json.Number:
+		problems = append(problems, validateJSONNumber(value, schema, path)...)
+	}
+
+	problems = append(problems, v.validateCombinators(value, schema, path)...)
+
+	return problems
+}
+
+func (v jsonSchemaValidator) validateObject(object map[string]any, schema map[string]any, path string) []string {
+	problems := []string{}
+	properties, _ := schema["properties"].(map[string]any)
+
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			key, _ := name.(string)
+			if _, ok := object[key]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required property %q", path, key))
+			}
+		}
+	}
+
+	// Go through the keys in order so the messages are stable
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		childPath := path + "." + key
+
+		if propertySchema, ok := properties[key].(map[string]any); ok {
+			problems = append(problems, v.validate(object[key], propertySchema, childPath)...)
+			continue
+		}
+
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				problems = append(problems, fmt.Sprintf("%s: property %q is not allowed", path, key))
+			}
+		case map[string]any:
+			problems = append(problems, v.validate(object[key], additional, childPath)...)
+		}
+	}
+
+	if min, ok := jsonSchemaInt(schema, "minProperties"); ok && len(object) < min {
+		problems = append(problems, fmt.Sprintf("%s: needs at least %d properties", path, min))
+	}
+
+	if max, ok := jsonSchemaInt(schema, "maxProperties"); ok && len(object) > max {
+		problems = append(problems, fmt.Sprintf("%s: allows at most %d properties", path, max))
+	}
+
+	return problems
+}
+
+func (v jsonSchemaValidator) validateArray(array []any, schema map[string]any, path string) []string {
+	problems := []string{}
+
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range array {
+			problems = append(problems, v.validate(item, items, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+
+	if min, ok := jsonSchemaInt(schema, "minItems"); ok && len(array) < min {
+		problems = append(problems, fmt.Sprintf("%s: needs at least %d items", path, min))
+	}
+
+	if max, ok := jsonSchemaInt(schema, "maxItems"); ok && len(array) > max {
+		problems = append(problems, fmt.Sprintf("%s: allows at most %d items", path, max))
+	}
+
+	if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+		for i := range array {
+			for j := i + 1; j < len(array); j++ {
+				if jsonEqual(array[i], array[j]) {
+					problems = append(problems, fmt.Sprintf("%s: items %d and %d are the same", path, i, j))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+func validateJSONString(s string, schema map[string]any, path string) []string {
+	problems := []string{}
+	length := len([]rune(s))
+
+	if min, ok := jsonSchemaInt(schema, "minLength"); ok && length < min {
+		problems = append(problems, fmt.Sprintf("%s: must be at least %d characters", path, min))
+	}
+
+	if max, ok := jsonSchemaInt(schema, "maxLength"); ok && length > max {
+		problems = append(problems, fmt.Sprintf("%s: must be at most %d characters", path, max))
+	}
+
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err == nil && !re.MatchString(s) {
+			problems = append(problems, fmt.Sprintf("%s: must match %q", path, pattern))
+		}
+	}
+
+	if format, ok := schema["format"].(string); ok {
+		if valid := jsonFormats[format]; valid != nil && !valid(s) {
+			problems = append(problems, fmt.Sprintf("%s: must be a valid %s", path, format))
+		}
+	}
+
+	return problems
+}
+
+// The string formats we can check
+var jsonFormats = map[string]func(string) bool{
+	"date-time": func(s string) bool {
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	},
+	"date": func(s string) bool {
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	},
+	"time": func(s string) bool {
+		_, err := time.Parse("15:04:05Z07:00", s)
+		if err != nil {
+			_, err = time.Parse("15:04:05.999999999Z07:00", s)
+		}
+		return err == nil
+	},
+	"email": func(s string) bool {
+		address, err := mail.ParseAddress(s)
+		return err == nil && address.Address == s
+	},
+	"uri": func(s string) bool {
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != ""
+	},
+	"uuid": regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`).MatchString,
+	"ipv4": func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && ip.To4() != nil && !strings.Contains(s, ":")
+	},
+	"ipv6": func(s string) bool {
+		ip := net.ParseIP(s)
+		return ip != nil && strings.Contains(s, ":")
+	},
+}
+
+func validateJSONNumber(n json.Number, schema map[string]any, path string) []string {
+	problems := []string{}
+	f, err := n.Float64()
+	if err != nil {
+		return problems
+	}
+
+	if min, ok := jsonSchemaFloat(schema, "minimum"); ok && f < min {
+		problems = append(problems, fmt.Sprintf("%s: must be at least %v", path, min))
+	}
+
+	if max, ok := jsonSchemaFloat(schema, "maximum"); ok && f > max {
+		problems = append(problems, fmt.Sprintf("%s: must be at most %v", path, max))
+	}
+
+	if min, ok := jsonSchemaFloat(schema, "exclusiveMinimum"); ok && f <= min {
+		problems = append(problems, fmt.Sprintf("%s: must be more than %v", path, min))
+	}
+
+	if max, ok := jsonSchemaFloat(schema, "exclusiveMaximum"); ok && f >= max {
+		problems = append(problems, fmt.Sprintf("%s: must be less than %v", path, max))
+	}
+
+	if step, ok := jsonSchemaFloat(schema, "multipleOf"); ok && step > 0 {
+		if quotient := f / step; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			problems = append(problems, fmt.Sprintf("%s: must be a multiple of %v", path, step))
+		}
+	}
+
+	return problems
+}
+
+func (v jsonSchemaValidator) validateCombinators(value any, schema map[string]any, path string) []string {
+	problems := []string{}
+
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			if subSchema, ok := sub.(map[string]any); ok {
+				problems = append(problems, v.validate(value, subSchema, path)...)
+			}
+		}
+	}
+
+	matching := func(options []any) int {
+		count := 0
+		for _, sub := range options {
+			if subSchema, ok := sub.(map[string]any); ok && len(v.validate(value, subSchema, path)) == 0 {
+				count++
+			}
+		}
+		return count
+	}
+
+	if anyOf, ok := schema["anyOf"].([]any); ok && matching(anyOf) == 0 {
+		problems = append(problems, fmt.Sprintf("%s: does not match any of the allowed schemas", path))
+	}
+
+	if oneOf, ok := schema["oneOf"].([]any); ok && matching(oneOf) != 1 {
+		problems = append(problems, fmt.Sprintf("%s: must match exactly one of the allowed schemas", path))
+	}
+
+	if not, ok := schema["not"].(map[string]any); ok && len(v.validate(value, not, path)) == 0 {
+		problems = append(problems, fmt.Sprintf("%s: matches a schema it must not", path))
+	}
+
+	return problems
+}
+
+/////////////
+
+// Whether a value has one of the schema's types. types is a string or a list
+func jsonTypeMatches(value any, types any) bool {
+	switch t := types.(type) {
+	case string:
+		return jsonIsType(value, t)
+	case []any:
+		for _, option := range t {
+			if name, ok := option.(string); ok && jsonIsType(value, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func jsonIsType(value any, name string) bool {
+	actual := jsonTypeName(value)
+
+	if name == "number" && actual == "integer" {
+		return true
+	}
+
+	return actual == name
+}
+
+// The JSON Schema type name of a decoded value
+func jsonTypeName(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	case json.Number:
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) && !strings.ContainsAny(v.String(), ".eE") {
+			return "integer"
+		}
+		return "number"
+	}
+
+	return "unknown"
+}
+
+// Compare two decoded values, numbers by value at any depth
+func jsonEqual(a any, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+
+		af, aErr := a.Float64()
+		bf, bErr := bn.Float64()
+		if aErr != nil || bErr != nil {
+			return a.String() == bn.String()
+		}
+
+		return af == bf
+
+	case []any:
+		bs, ok := b.([]any)
+		if !ok || len(a) != len(bs) {
+			return false
+		}
+
+		for i := range a {
+			if !jsonEqual(a[i], bs[i]) {
+				return false
+			}
+		}
+
+		return true
+
+	case map[string]any:
+		bm, ok := b.(map[string]any)
+		if !ok || len(a) != len(bm) {
+			return false
+		}
+
+		for key, value := range a {
+			other, ok := bm[key]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	// What is left is null, a boolean or a string
+	return a == b
+}
+
+// Read a numeric keyword from a schema. Both the schema and the document
+// are decoded with UseNumber
+func jsonSchemaFloat(schema map[string]any, keyword string) (float64, bool) {
+	n, ok := schema[keyword].(json.Number)
+	if !ok {
+		return 0, false
+	}
+
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+func jsonSchemaInt(schema map[string]any, keyword string) (int, bool) {
+	f, ok := jsonSchemaFloat(schema, keyword)
+	return int(f), ok
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateJSONAgainstSchema(t *testing.T) {
+	tests := []struct {
+		name     string
+		schema   string
+		document string
+		problems []string // Each one has to show up in the problems
+	}{
+		{"valid object", `{"type":"object","properties":{"name":{"type":"string"}},"required":["name"]}`, `{"name":"thyme"}`, nil},
+		{"missing property", `{"type":"object","required":["name"]}`, `{}`, []string{`$: missing required property "name"`}},
+		{"wrong type", `{"type":"object","properties":{"age":{"type":"integer"}}}`, `{"age":"old"}`, []string{"$.age"}},
+		{"integer", `{"type":"integer"}`, `3.5`, []string{"$"}},
+		{"no additional properties", `{"type":"object","additionalProperties":false}`, `{"x":1}`, []string{"x"}},
+		{"array items", `{"type":"array","items":{"type":"number"},"minItems":2}`, `[1,"two"]`, []string{"$[1]"}},
+		{"range", `{"type":"number","minimum":1,"exclusiveMaximum":10}`, `10`, []string{"less than 10"}},
+		{"multiple of", `{"type":"number","multipleOf":0.5}`, `1.25`, []string{"multiple of 0.5"}},
+		{"multiple of ok", `{"type":"number","multipleOf":0.1}`, `0.3`, nil},
+		{"pattern", `{"type":"string","pattern":"^[a-z]+$"}`, `"Thyme"`, []string{"must match"}},
+		{"enum number", `{"enum":[1,2,3]}`, `2.0`, nil},
+		{"enum nested numbers", `{"enum":[{"sizes":[1,2]}]}`, `{"sizes":[1,2]}`, nil},
+		{"enum nested mismatch", `{"enum":[{"sizes":[1,2]}]}`, `{"sizes":[1,3]}`, []string{"$"}},
+		{"const object", `{"const":{"a":[1,{"b":2.5}]}}`, `{"a":[1,{"b":2.50}]}`, nil},
+		{"one of", `{"oneOf":[{"type":"string"},{"type":"number"}]}`, `true`, []string{"exactly one"}},
+		{"not", `{"not":{"type":"string"}}`, `"text"`, []string{"must not"}},
+		{"date-time", `{"type":"string","format":"date-time"}`, `"2023-07-01T12:00:00Z"`, nil},
+		{"bad date-time", `{"type":"string","format":"date-time"}`, `"yesterday"`, []string{"must be a valid date-time"}},
+		{"bad date", `{"type":"string","format":"date"}`, `"2023-13-01"`, []string{"must be a valid date"}},
+		{"email", `{"type":"string","format":"email"}`, `"cook@example.com"`, nil},
+		{"bad email", `{"type":"string","format":"email"}`, `"cook at example"`, []string{"must be a valid email"}},
+		{"bad uri", `{"type":"string","format":"uri"}`, `"not a link"`, []string{"must be a valid uri"}},
+		{"uuid", `{"type":"string","format":"uuid"}`, `"123e4567-e89b-12d3-a456-426614174000"`, nil},
+		{"bad ipv4", `{"type":"string","format":"ipv4"}`, `"::1"`, []string{"must be a valid ipv4"}},
+		{"ipv6", `{"type":"string","format":"ipv6"}`, `"::1"`, nil},
+		{
+			"definitions ref",
+			`{"type":"object","properties":{"plant":{"$ref":"#/definitions/plant"}},"definitions":{"plant":{"type":"object","required":["name"]}}}`,
+			`{"plant":{}}`,
+			[]string{`$.plant: missing required property "name"`},
+		},
+		{
+			"defs ref",
+			`{"type":"array","items":{"$ref":"#/$defs/size"},"$defs":{"size":{"enum":["S","M","L"]}}}`,
+			`["S","XL"]`,
+			[]string{"$[1]"},
+		},
+		{
+			"recursive ref",
+			`{"type":"object","properties":{"name":{"type":"string"},"children":{"type":"array","items":{"$ref":"#"}}}}`,
+			`{"name":"root","children":[{"name":"leaf","children":[{"name":7}]}]}`,
+			[]string{"$.children[0].children[0].name"},
+		},
+		{"not json", `{"type":"object"}`, `{"name":`, []string{"not valid JSON"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schema, err := parseJSONSchema([]byte(tt.schema))
+			if err != nil {
+				t.Fatalf("the schema was refused: %v", err)
+			}
+
+			problems := validateJSONAgainstSchema([]byte(tt.document), schema)
+
+			if len(tt.problems) == 0 && len(problems) > 0 {
+				t.Fatalf("got problems for a valid document: %q", problems)
+			}
+
+			if len(tt.problems) > 0 && len(problems) == 0 {
+				t.Fatalf("no problems, want %q", tt.problems)
+			}
+
+			joined := strings.Join(problems, "\n")
+			for _, want := range tt.problems {
+				if !strings.Contains(joined, want) {
+					t.Errorf("problems %q do not mention %q", problems, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseJSONSchemaRefuses(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		err    string
+	}{
+		{"not json", `{"type":`, "not valid JSON"},
+		{"unknown format", `{"type":"string","format":"hostname"}`, "hostname format"},
+		{"remote ref", `{"$ref":"https://example.com/plant.json"}`, "inside the schema"},
+		{"missing ref", `{"$ref":"#/definitions/plant"}`, "points nowhere"},
+		{"unsupported keyword", `{"type":"object","patternProperties":{"^x":{"type":"string"}}}`, "patternProperties"},
+		{"nested unsupported keyword", `{"type":"object","properties":{"when":{"if":{"type":"string"}}}}`, "#/properties/when"},
+		{"unsupported keyword in a definition", `{"$defs":{"list":{"contains":{"type":"number"}}}}`, "contains"},
+		{"items as a list", `{"type":"array","items":[{"type":"string"}]}`, "items as a list"},
+		{"bad pattern", `{"type":"string","pattern":"(unclosed"}`, "regular expression"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseJSONSchema([]byte(tt.schema))
+			if err == nil {
+				t.Fatalf("the schema was accepted, want an error about %s", tt.err)
+			}
+
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("err = %v, want it to mention %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestResolveJSONSchemaRef(t *testing.T) {
+	schema, err := parseJSONSchema([]byte(`{"definitions":{"a/b":{"type":"string"},"c~d":{"type":"number"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{"#/definitions/a~1b", "string"},
+		{"#/definitions/c~0d", "number"},
+	}
+
+	for _, tt := range tests {
+		resolved, err := resolveJSONSchemaRef(schema, tt.ref)
+		if err != nil {
+			t.Errorf("%s: %v", tt.ref, err)
+			continue
+		}
+
+		if resolved["type"] != tt.want {
+			t.Errorf("%s resolved to %v, want type %s", tt.ref, resolved, tt.want)
+		}
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/mattn/go-isatty"
+	"golang.org/x/term"
+)
+
+/////////////////
+
+// The chat's input. On a terminal it edits like readline, and Up and Down go
+// through what was typed in earlier chats. A message can span lines:
+// Alt-Enter or Ctrl-J start a new line, pasted text keeps its new lines, a
+// first line of <<EOF takes every line up to EOF, and Ctrl-X Ctrl-E writes
+// the message in $EDITOR. Piped input is read a line at a time
+
+// Ctrl-C on an empty line
+var errInputCancelled = errors.New("input cancelled")
+
+// The most inputs the history file keeps
+const inputHistorySize = 1000
+
+type lineEditor struct {
+	fd          int
+	reader      *bufio.Reader
+	terminal    bool
+	history     []string
+	historyFile string
+	prefill     string // What the next message starts with, for /edit
+}
+
+func newLineEditor(historyFile string) *lineEditor {
+	return &lineEditor{
+		fd:          int(os.Stdin.Fd()),
+		reader:      bufio.NewReader(os.Stdin),
+		terminal:    isatty.IsTerminal(os.Stdin.Fd()) && isatty.IsTerminal(os.Stdout.Fd()),
+		history:     loadInputHistory(historyFile),
+		historyFile: historyFile,
+	}
+}
+
+// Where the inputs are remembered, THYME_INPUT_HISTORY or the config dir.
+// Empty when there is nowhere to keep them
+func inputHistoryFile() string {
+	if file, ok := os.LookupEnv("THYME_INPUT_HISTORY"); ok {
+		return file
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(configDir, "thyme", "input_history.jsonl")
+}
+
+/////////////////
+
+// Read a message. Returns io.EOF on Ctrl-D or the end of the input, and
+// errInputCancelled on Ctrl-C
+func (e *lineEditor) readInput(prompt string) (string, error) {
+	if !e.terminal {
+		e.prefill = ""
+		fmt.Print(prompt)
+		return e.readPiped()
+	}
+
+	text, err := e.edit(prompt)
+	if err == nil {
+		e.remember(text)
+	}
+
+	return text, err
+}
+
+// Piped input is a message a line, or the lines between <<EOF and EOF
+func (e *lineEditor) readPiped() (string, error) {
+	line, err := e.readLine()
+	if err != nil {
+		return "", err
+	}
+
+	delimiter, ok := heredocDelimiter(line)
+	if !ok {
+		return line, nil
+	}
+
+	lines := []string{}
+	for {
+		next, err := e.readLine()
+		if err == io.EOF || next == delimiter {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		lines = append(lines, next)
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+func (e *lineEditor) readLine() (string, error) {
+	line, err := e.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+var heredocRegex = regexp.MustCompile(`^<<\s*['"]?(\w+)['"]?\s*$`)
+
+// The delimiter of a line like <<EOF
+func heredocDelimiter(line string) (string, bool) {
+	match := heredocRegex.FindStringSubmatch(line)
+	if match == nil {
+		return "", false
+	}
+
+	return match[1], true
+}
+
+/////////////////
+
+// Edit a message on the terminal until it is sent with Enter
+func (e *lineEditor) edit(prompt string) (string, error) {
+	oldState, err := term.MakeRaw(e.fd)
+	if err != nil {
+		fmt.Print(prompt)
+		return e.readPiped()
+	}
+
+	// Pastes come marked, so their new lines stay in the message
+	fmt.Print("\x1b[?2004h")
+
+	defer func() {
+		fmt.Print("\x1b[?2004l")
+		term.Restore(e.fd, oldState)
+	}()
+
+	s := newEditState(prompt, e.history)
+
+	if e.prefill != "" {
+		s.buf = []rune(e.prefill)
+		s.pos = len(s.buf)
+		e.prefill = ""
+	}
+
+	s.render()
+
+	pending := []byte{}
+	chunk := make([]byte, 4096)
+
+	for {
+		n, err := e.reader.Read(chunk)
+		if err != nil {
+			s.finish()
+			return "", err
+		}
+
+		pending = append(pending, chunk[:n]...)
+
+		for len(pending) > 0 {
+			key, rest, ok := parseEditorKey(pending)
+			if !ok {
+				// Wait for the rest of an escape sequence or character
+				break
+			}
+			pending = rest
+
+			action, text := s.apply(key)
+
+			switch action {
+			case editSend:
+				s.finish()
+				return text, nil
+
+			case editCancel:
+				s.finish()
+				return "", errInputCancelled
+
+			case editEOF:
+				s.finish()
+				return "", io.EOF
+
+			case editDiscard:
+				// Throw away what was typed and start over
+				s.moveTo(len(s.buf))
+				s.render()
+				fmt.Print("^C")
+				s.finish()
+				s = newEditState(prompt, e.history)
+
+			case editClearScreen:
+				fmt.Print("\x1b[H\x1b[2J")
+				s.cursorRow = 0
+
+			case editOpenEditor:
+				if err := e.editInEditor(s, oldState); err != nil {
+					fmt.Printf("Could not open the editor: %s\r\n", err)
+				}
+			}
+		}
+
+		s.render()
+	}
+}
+
+// Write the message in $VISUAL or $EDITOR, vi without them. It comes back
+// to the input to be looked over and sent
+func (e *lineEditor) editInEditor(s *editState, rawState *term.State) error {
+	s.clear()
+
+	file, err := os.CreateTemp("", "thyme-*.md")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString(string(s.buf))
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// Give the terminal to the editor
+	fmt.Print("\x1b[?2004l")
+	term.Restore(e.fd, rawState)
+
+	args := append(strings.Fields(editor), file.Name())
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	runErr := cmd.Run()
+
+	if _, err := term.MakeRaw(e.fd); err != nil {
+		return err
+	}
+	fmt.Print("\x1b[?2004h")
+
+	if runErr != nil {
+		return runErr
+	}
+
+	data, err := os.ReadFile(file.Name())
+	if err != nil {
+		return err
+	}
+
+	s.buf = []rune(strings.TrimRight(string(data), "\n"))
+	s.pos = len(s.buf)
+
+	return nil
+}
+
+// Remember a sent message, in memory and in the history file
+func (e *lineEditor) remember(text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+
+	if len(e.history) > 0 && e.history[len(e.history)-1] == text {
+		return
+	}
+
+	e.history = append(e.history, text)
+
+	if e.historyFile == "" {
+		return
+	}
+
+	// Keep the file from growing forever
+	if len(e.history) > inputHistorySize {
+		e.history = e.history[len(e.history)-inputHistorySize:]
+		saveInputHistory(e.historyFile, e.history, os.O_TRUNC)
+		return
+	}
+
+	saveInputHistory(e.historyFile, []string{text}, os.O_APPEND)
+}
+
+/////////////////
+
+// The history file has a JSON string on every line, so inputs can have new lines
+func loadInputHistory(filename string) []string {
+	history := []string{}
+
+	if filename == "" {
+		return history
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return history
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var text string
+		if err := json.Unmarshal(scanner.Bytes(), &text); err == nil {
+			history = append(history, text)
+		}
+	}
+
+	if len(history) > inputHistorySize {
+		history = history[len(history)-inputHistorySize:]
+	}
+
+	return history
+}
+
+// Write inputs to the history file, mode is os.O_APPEND or os.O_TRUNC
+func saveInputHistory(filename string, inputs []string, mode int) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|mode, 0600)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	for _, text := range inputs {
+		line, _ := json.Marshal(text)
+		file.Write(append(line, '\n'))
+	}
+}
+
+/////////////////
+
+// Draw the prompt and the message
+func (s *editState) render() {
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+
+	out, cursorRow, endRow := s.layout(width)
+	s.cursorRow, s.endRow = cursorRow, endRow
+
+	fmt.Print(out)
+}
+
+// Leave the cursor on a new line under the message
+func (s *editState) finish() {
+	if s.endRow > s.cursorRow {
+		fmt.Printf("\x1b[%dB", s.endRow-s.cursorRow)
+	}
+	fmt.Print("\r\n")
+}
+
+// Take the prompt and message off the screen
+func (s *editState) clear() {
+	if s.cursorRow > 0 {
+		fmt.Printf("\x1b[%dA", s.cursorRow)
+	}
+	fmt.Print("\r\x1b[J")
+	s.cursorRow = 0
+}
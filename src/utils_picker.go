@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/charmbracelet/bubbles/textinput"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/sahilm/fuzzy"
+)
+
+/////////////////
+
+// An interactive fuzzy finder over the prompts, opened by thyme pick or -p
+// without a name. It draws on stderr and reads keys from the terminal, so
+// the input can be piped in and the answer piped out
+
+type promptPicker struct {
+	prompts []Prompt // Sorted and grouped by source
+	matches []Prompt // What the query matches, best first
+	query   textinput.Model
+	cursor  int
+	chosen  *Prompt
+	width   int
+	height  int
+	styles  pickerStyles
+}
+
+type pickerStyles struct {
+	group       lipgloss.Style
+	name        lipgloss.Style
+	selected    lipgloss.Style
+	description lipgloss.Style
+	preview     lipgloss.Style
+	title       lipgloss.Style
+	help        lipgloss.Style
+}
+
+// What the fuzzy finder matches on: the names, or the names and descriptions
+type promptSearchSource struct {
+	prompts      []Prompt
+	descriptions bool
+}
+
+func (s promptSearchSource) String(i int) string {
+	if s.descriptions {
+		return s.prompts[i].Name + " " + s.prompts[i].Description
+	}
+
+	return s.prompts[i].Name
+}
+
+func (s promptSearchSource) Len() int {
+	return len(s.prompts)
+}
+
+/////////////////
+
+// Let the user pick a prompt. Returns false when they cancelled
+func pickPrompt(prompts map[string]Prompt) (Prompt, bool, error) {
+	renderer := lipgloss.NewRenderer(os.Stderr)
+
+	query := textinput.New()
+	query.Placeholder = "type to search the prompts"
+	query.Prompt = "> "
+	query.Focus()
+
+	picker := promptPicker{
+		prompts: sortedPrompts(prompts),
+		query:   query,
+		styles: pickerStyles{
+			group:       renderer.NewStyle().Foreground(lipgloss.Color("#f3f6f4")).Bold(true),
+			name:        renderer.NewStyle().Foreground(lipgloss.Color("#1FC3B7")),
+			selected:    renderer.NewStyle().Foreground(lipgloss.Color("#04B575")).Bold(true),
+			description: renderer.NewStyle().Foreground(lipgloss.Color("#808080")),
+			preview:     renderer.NewStyle().Border(lipgloss.RoundedBorder()).BorderForeground(lipgloss.Color("#1FC3B7")).Padding(0, 1),
+			title:       renderer.NewStyle().Foreground(lipgloss.Color("#8de765")).Bold(true),
+			help:        renderer.NewStyle().Foreground(lipgloss.Color("#808080")),
+		},
+	}
+	picker.matches = picker.prompts
+
+	program := tea.NewProgram(picker, tea.WithOutput(os.Stderr), tea.WithInputTTY(), tea.WithAltScreen())
+
+	final, err := program.Run()
+	if err != nil {
+		return Prompt{}, false, err
+	}
+
+	chosen := final.(promptPicker).chosen
+	if chosen == nil {
+		return Prompt{}, false, nil
+	}
+
+	return *chosen, true, nil
+}
+
+/////////////////
+
+func (m promptPicker) Init() tea.Cmd {
+	return textinput.Blink
+}
+
+func (m promptPicker) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+		return m, nil
+
+	case tea.KeyMsg:
+		switch msg.String() {
+		case "ctrl+c", "esc":
+			return m, tea.Quit
+
+		case "enter":
+			if len(m.matches) > 0 {
+				m.chosen = &m.matches[m.cursor]
+			}
+			return m, tea.Quit
+
+		case "up", "ctrl+p", "ctrl+k":
+			if m.cursor > 0 {
+				m.cursor--
+			}
+			return m, nil
+
+		case "down", "ctrl+n", "ctrl+j":
+			if m.cursor < len(m.matches)-1 {
+				m.cursor++
+			}
+			return m, nil
+		}
+	}
+
+	before := m.query.Value()
+
+	var cmd tea.Cmd
+	m.query, cmd = m.query.Update(msg)
+
+	if m.query.Value() != before {
+		m.search()
+	}
+
+	return m, cmd
+}
+
+// Filter the prompts with the query. Without a query they stay grouped
+func (m *promptPicker) search() {
+	m.cursor = 0
+
+	pattern := strings.TrimSpace(m.query.Value())
+	if pattern == "" {
+		m.matches = m.prompts
+		return
+	}
+
+	// Prompts whose name matches come first, then the ones that only
+	// match with their description
+	m.matches = []Prompt{}
+	seen := map[int]bool{}
+
+	for _, descriptions := range []bool{false, true} {
+		for _, match := range fuzzy.FindFrom(pattern, promptSearchSource{m.prompts, descriptions}) {
+			if !seen[match.Index] {
+				seen[match.Index] = true
+				m.matches = append(m.matches, m.prompts[match.Index])
+			}
+		}
+	}
+}
+
+/////////////////
+
+func (m promptPicker) View() string {
+	width, height := m.width, m.height
+	if width == 0 {
+		width, height = 100, 24
+	}
+
+	listWidth := width * 2 / 5
+	previewWidth := width - listWidth - 4
+	bodyHeight := height - 4
+
+	list := m.listView(listWidth, bodyHeight)
+	preview := m.previewView(previewWidth, bodyHeight)
+
+	body := lipgloss.JoinHorizontal(lipgloss.Top,
+		lipgloss.NewStyle().Width(listWidth).Render(list),
+		"  ",
+		preview,
+	)
+
+	help := m.styles.help.Render(fmt.Sprintf("%d/%d • ↑/↓ move • enter run • esc cancel", len(m.matches), len(m.prompts)))
+
+	return m.query.View() + "\n\n" + body + "\n" + help
+}
+
+// The list of matches, scrolled so the cursor stays in sight. Source
+// headers are only shown when the list is not filtered
+func (m promptPicker) listView(width int, height int) string {
+	grouped := strings.TrimSpace(m.query.Value()) == ""
+
+	lines := []string{}
+	cursorLine := 0
+	source := ""
+
+	for i, prompt := range m.matches {
+		if grouped && prompt.Source != source {
+			source = prompt.Source
+			lines = append(lines, m.styles.group.Render(truncateToWidth(source, width)))
+		}
+
+		if i == m.cursor {
+			cursorLine = len(lines)
+		}
+
+		line := "  " + m.styles.name.Render(prompt.Name)
+		if i == m.cursor {
+			line = "› " + m.styles.selected.Render(prompt.Name)
+		}
+
+		if room := width - lipgloss.Width(line) - 1; room > 3 && prompt.Description != "" {
+			line += " " + m.styles.description.Render(truncateToWidth(prompt.Description, room))
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		return m.styles.description.Render("No prompts match")
+	}
+
+	// Scroll so the cursor is on screen
+	start := 0
+	if cursorLine >= height {
+		start = cursorLine - height + 1
+	}
+
+	end := start + height
+	if end > len(lines) {
+		end = len(lines)
+	}
+
+	return strings.Join(lines[start:end], "\n")
+}
+
+// Everything about the prompt under the cursor
+func (m promptPicker) previewView(width int, height int) string {
+	if len(m.matches) == 0 || width < 10 {
+		return ""
+	}
+
+	prompt := m.matches[m.cursor]
+	inner := width - 4
+
+	parts := []string{
+		m.styles.title.Render(prompt.Name),
+		m.styles.description.Render(prompt.Source + ", " + prompt.summary()),
+	}
+
+	if prompt.Description != "" {
+		parts = append(parts, "", prompt.Description)
+	}
+
+	if settings := prompt.Defaults.describe(); settings != "" {
+		parts = append(parts, "", m.styles.description.Render(settings))
+	}
+
+	parts = append(parts, "")
+
+	if prompt.isChain() {
+		for i, step := range prompt.Steps {
+			parts = append(parts, fmt.Sprintf("%d. %s", i+1, step.describe()))
+		}
+	} else {
+		parts = append(parts, prompt.Text)
+	}
+
+	text := lipgloss.NewStyle().Width(inner).Render(strings.Join(parts, "\n"))
+
+	// Cut the preview to the screen, the border takes two lines
+	lines := strings.Split(text, "\n")
+	if len(lines) > height-2 && height > 3 {
+		lines = append(lines[:height-3], "...")
+	}
+
+	return m.styles.preview.Width(width - 2).Render(strings.Join(lines, "\n"))
+}
+
+/////////////////
+
+// Cut a single line of text down to a width, with an ellipsis
+func truncateToWidth(s string, width int) string {
+	s = strings.Join(strings.Fields(s), " ")
+
+	if lipgloss.Width(s) <= width {
+		return s
+	}
+
+	runes := []rune(s)
+	for len(runes) > 0 && lipgloss.Width(string(runes))+1 > width {
+		runes = runes[:len(runes)-1]
+	}
+
+	return string(runes) + "…"
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/alecthomas/chroma"
 	"github.com/alecthomas/chroma/formatters"
@@ -24,6 +26,9 @@ type FontStyle struct {
 	historyTitle lipgloss.Style
 	historyInfo  lipgloss.Style
 	historyText  lipgloss.Style
+	testPass     lipgloss.Style
+	testFail     lipgloss.Style
+	chatWarning  lipgloss.Style
 }
 
 var (
@@ -32,12 +37,18 @@ var (
 	historyTitle = lipgloss.NewStyle().Foreground(lipgloss.Color("#f3f6f4")).Bold(true)
 	historyInfo  = lipgloss.NewStyle().Foreground(lipgloss.Color("#1FC3B7"))
 	historyText  = lipgloss.NewStyle().Foreground(lipgloss.Color("#8de765"))
+	testPass     = lipgloss.NewStyle().Foreground(lipgloss.Color("#04B575")).Bold(true)
+	testFail     = lipgloss.NewStyle().Foreground(lipgloss.Color("#E8505B")).Bold(true)
+	warningText  = lipgloss.NewStyle().Foreground(lipgloss.Color("#E8B730"))
 
 	fontStyles = FontStyle{
 		spinnerText:  spinnerText,
 		historyTitle: historyTitle,
 		historyInfo:  historyInfo,
 		historyText:  historyText,
+		testPass:     testPass,
+		testFail:     testFail,
+		chatWarning:  warningText,
 	}
 )
 
@@ -103,43 +114,114 @@ func typeWriterPrint(s string, space bool) {
 
 /////////////////
 
+// What the spinner shows after "Querying...", such as retry progress
+var (
+	spinnerStatus     string
+	spinnerStatusLock sync.Mutex
+)
+
+// Set the text shown next to the spinner. Empty to clear it
+func setSpinnerStatus(s string) {
+	spinnerStatusLock.Lock()
+	defer spinnerStatusLock.Unlock()
+	spinnerStatus = s
+}
+
+func getSpinnerStatus() string {
+	spinnerStatusLock.Lock()
+	defer spinnerStatusLock.Unlock()
+	return spinnerStatus
+}
+
 // Function that is a spinner that last until a query is done
+// Checks for completion between every frame so streamed answers are not held up
 func spinner(spinningComplete chan bool) {
+	setSpinnerStatus("")
+
+	// The widest line we printed, so we know how much to clear
+	width := 0
+
 	for {
 
 		for _, r := range `▁▂▃▄▅▆▇█▇▆▅▄▃▂▁` {
-			prettyPrintSpinner(fmt.Sprintf("\r%c Querying...", r))
-			time.Sleep(time.Millisecond * 100)
-		}
+			line := fmt.Sprintf("%c Querying... %s", r, getSpinnerStatus())
 
-		select {
-		case value := <-spinningComplete:
-			if value == true {
-				fmt.Printf("\r                    \r")
-				return
+			if n := utf8.RuneCountInString(line); n > width {
+				width = n
 			}
 
-		default:
-			continue
+			// Pad to clear whatever was left of a longer line
+			prettyPrintSpinner(fmt.Sprintf("\r%-*s", width, line))
+
+			select {
+			case value := <-spinningComplete:
+				if value == true {
+					fmt.Printf("\r%s\r", strings.Repeat(" ", width))
+
+					// Let stopSpinner know the line is clear
+					spinningComplete <- true
+					return
+				}
+
+			case <-time.After(time.Millisecond * 100):
+			}
 		}
 	}
 }
 
+// Stop a running spinner and wait until it has cleared its line, so nothing
+// we print afterwards gets wiped
+func stopSpinner(spinningComplete chan bool) {
+	spinningComplete <- true
+	<-spinningComplete
+}
+
 /////////////////
 
 // Display the available prompts to the user
-func listAvailablePrompts() {
+func listAvailablePrompts(prompts map[string]Prompt) {
+
+	fmt.Printf("Available prompts:\n")
 
-	prompts := initPrompts()
+	// Sorted and grouped by where they came from
+	source := ""
+	for _, prompt := range sortedPrompts(prompts) {
+		if prompt.Source != source {
+			source = prompt.Source
+			fmt.Printf("\n%s:\n\n", source)
+		}
 
-	fmt.Printf("Available prompts:\n\n")
-	for _, prompt := range prompts {
-		fmt.Printf("- %s: %s\n", prompt.Name, prompt.Description)
+		fmt.Printf("- %s: %s [%s]\n", prompt.Name, prompt.Description, prompt.summary())
+	}
+
+	// Let the user know about prompts with the same name
+	collisions := promptCollisions(prompts)
+
+	if len(collisions) > 0 {
+		fmt.Printf("\nName collisions:\n\n")
+		for _, prompt := range collisions {
+			fmt.Printf("- %s: using %s, replacing %s\n", prompt.Name, prompt.Source, strings.Join(prompt.Overrides, ", "))
+		}
 	}
 }
 
 /////////////////
 
+// Format the references a provider returned as a numbered list
+func referencesToString(references []ProviderReference) string {
+	var output string
+
+	output += "Sources:\n----------\n"
+
+	for a, source := range references {
+		output += fmt.Sprintf("[%d] %s\n%s\n%s\n\n", a+1, source.Title, source.URL, source.Snippet)
+	}
+
+	return output
+}
+
+/////////////////
+
 // Pretty print the text green
 func prettyPrintSpinner(s string) {
 	fmt.Printf("%s", spinnerText.Render(s))
@@ -204,6 +286,19 @@ func prettyPrintCode(s string, language string) string {
 
 /////////////////
 
+// The contents of the fenced code blocks in a markdown text, without the
+// fences and language names
+func extractCodeBlocks(s string) []string {
+	codeBlockRegex := regexp.MustCompile("(?s)```[^\n]*\n(.*?)```")
+
+	blocks := []string{}
+	for _, match := range codeBlockRegex.FindAllStringSubmatch(s, -1) {
+		blocks = append(blocks, match[1])
+	}
+
+	return blocks
+}
+
 // Format just the codeblocks in Markdown
 // Function written by GPT-4
 func formatCodeBlocksInMarkdown(s string, language string) string {
@@ -227,6 +322,82 @@ func formatCodeBlocksInMarkdown(s string, language string) string {
 
 /////////////////
 
+// Prints a markdown answer as it is streamed in. Text outside of code blocks is
+// printed straight away, code blocks are held back until their closing fence
+// arrives so they can be highlighted with formatCodeBlocksInMarkdown
+type markdownStreamPrinter struct {
+	language string
+	color    bool // Highlight code blocks. Off when quiet
+	started  bool // Whether we printed anything yet, to drop leading new lines
+	inCode   bool
+	pending  string
+}
+
+func newMarkdownStreamPrinter(language string, color bool) *markdownStreamPrinter {
+	return &markdownStreamPrinter{language: language, color: color}
+}
+
+// Add a token to the answer, printing whatever can be printed
+func (p *markdownStreamPrinter) Write(token string) {
+	if !p.started {
+		token = removeLeadingNewLines(token)
+
+		if token == "" {
+			return
+		}
+
+		p.started = true
+	}
+
+	p.pending += token
+
+	for {
+		if p.inCode {
+			// Look for the closing fence after the opening one
+			end := strings.Index(p.pending[3:], "```")
+			if end == -1 {
+				return
+			}
+
+			end += 6
+			p.printCode(p.pending[:end])
+			p.pending = p.pending[end:]
+			p.inCode = false
+			continue
+		}
+
+		start := strings.Index(p.pending, "```")
+		if start == -1 {
+			// Hold back trailing backticks, they could be the start of a fence
+			keep := len(p.pending) - len(strings.TrimRight(p.pending, "`"))
+			fmt.Print(p.pending[:len(p.pending)-keep])
+			p.pending = p.pending[len(p.pending)-keep:]
+			return
+		}
+
+		fmt.Print(p.pending[:start])
+		p.pending = p.pending[start:]
+		p.inCode = true
+	}
+}
+
+// Print whatever is left, such as a code block that was never closed
+func (p *markdownStreamPrinter) Flush() {
+	fmt.Print(p.pending)
+	p.pending = ""
+	p.inCode = false
+}
+
+func (p *markdownStreamPrinter) printCode(block string) {
+	if p.color {
+		block = formatCodeBlocksInMarkdown(block, p.language)
+	}
+
+	fmt.Print(block)
+}
+
+/////////////////
+
 // Using the enry package for language detection
 func detectProgrammingLanguageEnry(text string) string {
 
@@ -1,5 +1,19 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
 ////////////
 
 type Prompt struct {
@@ -7,6 +21,12 @@ type Prompt struct {
 	Text        string
 	Description string
 	Examples    map[int]PromptExample // Number them in order to be passed
+	Steps       []ChainStep           // Set when the prompt is a chain of other prompts
+	Defaults    PromptDefaults        // Used unless the matching flags are given
+	Literal     bool                  // Sent as written instead of filled in as a template, like -c text
+
+	Source    string   // "built-in" or the file the prompt was loaded from
+	Overrides []string // Sources of prompts with the same name this one replaced
 }
 
 type PromptExample struct {
@@ -20,17 +40,87 @@ type QuerySave struct {
 	Answer string
 }
 
+// Settings a prompt runs with by default. Flags given on the command line
+// win over them
+type PromptDefaults struct {
+	Provider    string   `json:"provider" yaml:"provider" toml:"provider"` // openai, kagi or fastgpt
+	Model       string   `json:"model" yaml:"model" toml:"model"`
+	Temperature *float32 `json:"temperature" yaml:"temperature" toml:"temperature"` // nil when not set, 0 can be asked for
+	MaxTokens   int      `json:"max_tokens" yaml:"max_tokens" toml:"max_tokens"`
+	Format      string   `json:"format" yaml:"format" toml:"format"`       // plain, json or code
+	Language    string   `json:"language" yaml:"language" toml:"language"` // For syntax highlighting
+}
+
+// The output formats a prompt can ask for
+var outputFormats = []string{"plain", "json", "code"}
+
+// A prompt as it is written in a prompt file
+type PromptDefinition struct {
+	PromptDefaults `yaml:",inline"`
+
+	Name        string                    `json:"name" yaml:"name" toml:"name"`
+	Description string                    `json:"description" yaml:"description" toml:"description"`
+	Text        string                    `json:"text" yaml:"text" toml:"text"`
+	Examples    []PromptExampleDefinition `json:"examples" yaml:"examples" toml:"examples"`
+	Steps       []ChainStep               `json:"steps" yaml:"steps" toml:"steps"`
+}
+
+// One example exchange in a prompt file: what the user sends, and the
+// answer we would like to get back
+type PromptExampleDefinition struct {
+	User      string `json:"user" yaml:"user" toml:"user"`
+	Assistant string `json:"assistant" yaml:"assistant" toml:"assistant"`
+}
+
+// One step of a chain. It runs a prompt by name, or one written out in
+// text, on the previous step's output. Kagi summaries need neither
+type ChainStep struct {
+	Prompt      string `json:"prompt" yaml:"prompt" toml:"prompt"`
+	Text        string `json:"text" yaml:"text" toml:"text"`
+	Provider    string `json:"provider" yaml:"provider" toml:"provider"` // openai (default), kagi or fastgpt
+	Model       string `json:"model" yaml:"model" toml:"model"`
+	SummaryType string `json:"summary_type" yaml:"summary_type" toml:"summary_type"` // kagi: summary or notes
+
+	Literal bool `json:"-" yaml:"-" toml:"-"` // Text is sent as written, for -c
+}
+
+// A prompt file holds either a single prompt, or a list of them under "prompts"
+type PromptFile struct {
+	PromptDefinition `yaml:",inline"`
+	Prompts          []PromptDefinition `json:"prompts" yaml:"prompts" toml:"prompts"`
+}
+
+const builtinPromptSource = "built-in"
+
 ////////////
 
-// All prompts are defined in this function initPrompts()
-// We may end up moving prompts to JSON files in an embed.FS object if they get too large
-// But for now we do not see that being required.
+// The built-in prompts are defined in builtinPrompts(). Everyone can add their
+// own in YAML, JSON or TOML files in the prompts directory, see promptDirs()
 
 ////////////
 
-// Initialize the map of prompt names to prompt structs
-// Defined prompts and examples in here
+// Initialize the map of prompt names to prompt structs: the built-in prompts,
+// then every prompt file. Later prompts replace earlier ones with the same name
 func initPrompts() map[string]Prompt {
+	prompts := builtinPrompts()
+
+	for _, dir := range promptDirs() {
+		for _, prompt := range loadPromptDir(dir) {
+			if existing, ok := prompts[prompt.Name]; ok {
+				prompt.Overrides = append(existing.Overrides, existing.Source)
+			}
+
+			prompts[prompt.Name] = prompt
+		}
+	}
+
+	return prompts
+}
+
+////////////
+
+// Defined prompts and examples in here
+func builtinPrompts() map[string]Prompt {
 	prompts := make(map[string]Prompt)
 
 	// Define prompts here
@@ -38,6 +128,10 @@ func initPrompts() map[string]Prompt {
 		Name:        "listify",
 		Text:        "Return a numbered list of actions items from the following text",
 		Description: "This prompt takes a block of text and returns a numbered list of action items.",
+		Examples: map[int]PromptExample{
+			1: {Name: "example_user", Text: "We are out of coffee, someone should order more. Also the printer on the second floor is jammed again."},
+			2: {Name: "example_assistant", Text: "1. Order more coffee.\n2. Fix the jammed printer on the second floor."},
+		},
 	}
 
 	prompts["active_voice"] = Prompt{
@@ -58,7 +152,436 @@ func initPrompts() map[string]Prompt {
 		Description: "This prompt takes a block of text and returns a summary paragraph and some notable points.",
 	}
 
+	for name, prompt := range prompts {
+		prompt.Source = builtinPromptSource
+		prompts[name] = prompt
+	}
+
 	return prompts
 }
 
 ////////////
+
+// The directories prompt files are loaded from, in order. THYME_PROMPTS_DIR
+// replaces the default ~/.config/thyme/prompts and can list several
+// directories separated by ':' (';' on Windows)
+func promptDirs() []string {
+	if dirs := os.Getenv("THYME_PROMPTS_DIR"); dirs != "" {
+		return filepath.SplitList(dirs)
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil
+	}
+
+	return []string{filepath.Join(configDir, "thyme", "prompts")}
+}
+
+// Load every prompt file in a directory, in filename order. Files that cannot
+// be read are reported and skipped. A missing directory has no prompts
+func loadPromptDir(dir string) []Prompt {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Could not read the prompts directory %s: %s\n", dir, err)
+		}
+
+		return nil
+	}
+
+	prompts := []Prompt{}
+
+	// ReadDir returns the entries sorted by filename
+	for _, entry := range entries {
+		if entry.IsDir() || !isPromptFile(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		loaded, err := loadPromptFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping prompt file %s: %s\n", path, err)
+			continue
+		}
+
+		prompts = append(prompts, loaded...)
+	}
+
+	return prompts
+}
+
+// Whether the file has an extension we can read prompts from
+func isPromptFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+
+	return false
+}
+
+// Load the prompts in a YAML, JSON or TOML file. A single prompt without a
+// name is named after the file
+func loadPromptFile(path string) ([]Prompt, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file PromptFile
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(data, &file)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	case ".toml":
+		err = toml.Unmarshal(data, &file)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	definitions := file.Prompts
+
+	if file.Text != "" || len(file.Steps) > 0 {
+		if file.Name == "" {
+			file.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		}
+
+		definitions = append([]PromptDefinition{file.PromptDefinition}, definitions...)
+	}
+
+	prompts := make([]Prompt, 0, len(definitions))
+
+	for i, definition := range definitions {
+		if definition.Name == "" || (definition.Text == "" && len(definition.Steps) == 0) {
+			return nil, fmt.Errorf("prompt %d needs a name, and a text or steps", i+1)
+		}
+
+		if err := definition.PromptDefaults.check(); err != nil {
+			return nil, fmt.Errorf("prompt %s: %w", definition.Name, err)
+		}
+
+		// Number the examples in the order they are written
+		examples := make(map[int]PromptExample)
+		for j, example := range definition.Examples {
+			if example.User == "" || example.Assistant == "" {
+				return nil, fmt.Errorf("example %d of prompt %s needs both a user and an assistant", j+1, definition.Name)
+			}
+
+			examples[2*j+1] = PromptExample{Name: "example_user", Text: example.User}
+			examples[2*j+2] = PromptExample{Name: "example_assistant", Text: example.Assistant}
+		}
+
+		prompts = append(prompts, Prompt{
+			Name:        definition.Name,
+			Text:        definition.Text,
+			Description: definition.Description,
+			Examples:    examples,
+			Steps:       definition.Steps,
+			Defaults:    definition.PromptDefaults,
+			Source:      path,
+		})
+	}
+
+	return prompts, nil
+}
+
+// The prompt in a prompt file given by its path instead of a name. The file
+// has to hold a single prompt
+func loadSinglePromptFile(path string) (Prompt, error) {
+	prompts, err := loadPromptFile(path)
+	if err != nil {
+		return Prompt{}, err
+	}
+
+	if len(prompts) != 1 {
+		return Prompt{}, fmt.Errorf("%s has %d prompts, put it in the prompts directory and pick one by name", path, len(prompts))
+	}
+
+	return prompts[0], nil
+}
+
+////////////
+
+// The prompt's examples as messages, in the order they are numbered.
+// example_user becomes a user message and example_assistant an assistant one
+func (p Prompt) exampleMessages() []ProviderMessage {
+	numbers := make([]int, 0, len(p.Examples))
+	for number := range p.Examples {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	messages := make([]ProviderMessage, 0, len(numbers))
+
+	for _, number := range numbers {
+		example := p.Examples[number]
+		role := "user"
+
+		if example.Name == "example_assistant" {
+			role = "assistant"
+		}
+
+		messages = append(messages, ProviderMessage{Role: role, Content: example.Text})
+	}
+
+	return messages
+}
+
+// Make sure the provider and format are ones we know
+func (d PromptDefaults) check() error {
+	switch d.Provider {
+	case "", "openai", "kagi", "fastgpt":
+	default:
+		return fmt.Errorf("unknown provider %s, use openai, kagi or fastgpt", d.Provider)
+	}
+
+	if d.Format != "" && !isOutputFormat(d.Format) {
+		return fmt.Errorf("unknown format %s, use %s", d.Format, strings.Join(outputFormats, ", "))
+	}
+
+	return nil
+}
+
+func isOutputFormat(format string) bool {
+	for _, known := range outputFormats {
+		if format == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Whether the prompt runs a chain of other prompts
+func (p Prompt) isChain() bool {
+	return len(p.Steps) > 0
+}
+
+// How many example exchanges the prompt has
+func (p Prompt) exampleCount() int {
+	count := 0
+
+	for _, example := range p.Examples {
+		if example.Name == "example_user" {
+			count++
+		}
+	}
+
+	return count
+}
+
+////////////
+
+// The prompts in display order: the built-in ones first, then each prompt
+// file, sorted by name within each source
+func sortedPrompts(prompts map[string]Prompt) []Prompt {
+	sorted := make([]Prompt, 0, len(prompts))
+	for _, prompt := range prompts {
+		sorted = append(sorted, prompt)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+
+		if a.Source != b.Source {
+			if a.Source == builtinPromptSource || b.Source == builtinPromptSource {
+				return a.Source == builtinPromptSource
+			}
+
+			return a.Source < b.Source
+		}
+
+		return a.Name < b.Name
+	})
+
+	return sorted
+}
+
+// A short note on what the prompt carries: its examples, or its steps
+func (p Prompt) summary() string {
+	if p.isChain() {
+		return fmt.Sprintf("chain of %d steps", len(p.Steps))
+	}
+
+	return fmt.Sprintf("%d examples", p.exampleCount())
+}
+
+// The settings that are set, on one line: "openai, gpt4, temperature 0.2"
+func (d PromptDefaults) describe() string {
+	parts := []string{}
+
+	for _, value := range []string{d.Provider, d.Model} {
+		if value != "" {
+			parts = append(parts, value)
+		}
+	}
+
+	if d.Temperature != nil {
+		parts = append(parts, fmt.Sprintf("temperature %g", *d.Temperature))
+	}
+
+	if d.MaxTokens != 0 {
+		parts = append(parts, fmt.Sprintf("max %d tokens", d.MaxTokens))
+	}
+
+	if d.Format != "" {
+		parts = append(parts, d.Format+" output")
+	}
+
+	if d.Language != "" {
+		parts = append(parts, d.Language)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// What a chain step runs, in a few words: "listify (openai, gpt4)"
+func (s ChainStep) describe() string {
+	what := s.Prompt
+	if what == "" && s.Text != "" {
+		what = fmt.Sprintf("%q", s.Text)
+	}
+
+	if what == "" {
+		what = "summary"
+	}
+
+	settings := PromptDefaults{Provider: s.Provider, Model: s.Model}.describe()
+	if settings == "" {
+		return what
+	}
+
+	return what + " (" + settings + ")"
+}
+
+////////////
+
+// Tell the user when the prompt they picked replaced others with the same name
+func warnPromptCollision(prompt Prompt) {
+	if len(prompt.Overrides) == 0 {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "Note: the prompt %q from %s replaces the one from %s\n",
+		prompt.Name, prompt.Source, strings.Join(prompt.Overrides, ", "))
+}
+
+// All prompts that replaced others, sorted by name
+func promptCollisions(prompts map[string]Prompt) []Prompt {
+	collisions := []Prompt{}
+
+	for _, prompt := range prompts {
+		if len(prompt.Overrides) > 0 {
+			collisions = append(collisions, prompt)
+		}
+	}
+
+	sort.Slice(collisions, func(i, j int) bool {
+		return collisions[i].Name < collisions[j].Name
+	})
+
+	return collisions
+}
+
+////////////
+
+// Variables set on the command line with -var key=value, for use in
+// prompt templates. -var can be given more than once
+type PromptVars map[string]string
+
+func (v PromptVars) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+func (v PromptVars) Set(s string) error {
+	key, value, found := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+
+	if !found || key == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+
+	v[key] = value
+	return nil
+}
+
+// The variables a prompt template can use: the input file's name, the
+// language of the input, today's date, and whatever the user set with -var.
+// The user's variables win over the built-in ones
+func promptTemplateVars(filename string, input string, language string, userVars PromptVars) map[string]string {
+	if language == "" && input != "" {
+		language = detectProgrammingLanguageEnry(input)
+	}
+
+	vars := map[string]string{
+		"Filename": filename,
+		"Basename": filepath.Base(filename),
+		"Language": language,
+		"Date":     time.Now().Format("2006-01-02"),
+	}
+
+	if filename == "" {
+		vars["Basename"] = ""
+	}
+
+	for key, value := range userVars {
+		vars[key] = value
+	}
+
+	return vars
+}
+
+// Fill in a prompt's template variables: {{.Language}}, {{.audience}}, ...
+// Using a variable that was not set is an error
+func renderPromptTemplate(text string, vars map[string]string) (string, error) {
+	tmpl, err := template.New("prompt").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, vars); err != nil {
+		return "", err
+	}
+
+	return rendered.String(), nil
+}
+
+// The prompt with the variables filled into its text and examples. Literal
+// prompts come back as they are
+func (p Prompt) render(vars map[string]string) (Prompt, error) {
+	if p.Literal {
+		return p, nil
+	}
+
+	text, err := renderPromptTemplate(p.Text, vars)
+	if err != nil {
+		return p, fmt.Errorf("prompt %s: %w", p.Name, err)
+	}
+
+	rendered := p
+	rendered.Text = text
+	rendered.Examples = make(map[int]PromptExample, len(p.Examples))
+
+	for number, example := range p.Examples {
+		exampleText, err := renderPromptTemplate(example.Text, vars)
+		if err != nil {
+			return p, fmt.Errorf("prompt %s, %s %d: %w", p.Name, example.Name, (number+1)/2, err)
+		}
+
+		rendered.Examples[number] = PromptExample{Name: example.Name, Text: exampleText}
+	}
+
+	return rendered, nil
+}
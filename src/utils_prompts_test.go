@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPromptRender(t *testing.T) {
+	vars := map[string]string{"Language": "Go", "audience": "beginners"}
+
+	tests := []struct {
+		name    string
+		prompt  Prompt
+		text    string
+		example string // What the first example turns into
+		err     string
+	}{
+		{
+			name:   "variables",
+			prompt: Prompt{Name: "explain", Text: "Explain this {{.Language}} code to {{.audience}}"},
+			text:   "Explain this Go code to beginners",
+		},
+		{
+			name: "examples are filled in too",
+			prompt: Prompt{Name: "explain", Text: "Explain", Examples: map[int]PromptExample{
+				1: {Name: "example_user", Text: "Some {{.Language}}"},
+				2: {Name: "example_assistant", Text: "An answer"},
+			}},
+			text:    "Explain",
+			example: "Some Go",
+		},
+		{
+			name:   "missing variable",
+			prompt: Prompt{Name: "explain", Text: "Explain this to {{.nobody}}"},
+			err:    "prompt explain",
+		},
+		{
+			name: "missing variable in an example",
+			prompt: Prompt{Name: "explain", Text: "Explain", Examples: map[int]PromptExample{
+				1: {Name: "example_user", Text: "a"},
+				2: {Name: "example_assistant", Text: "b"},
+				3: {Name: "example_user", Text: "{{.nobody}}"},
+				4: {Name: "example_assistant", Text: "d"},
+			}},
+			err: "example_user 2",
+		},
+		{
+			name:   "literal text is sent as written",
+			prompt: Prompt{Name: "-c", Text: "Fill in {{ .Name }} in this Jinja template", Literal: true},
+			text:   "Fill in {{ .Name }} in this Jinja template",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered, err := tt.prompt.render(vars)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want one mentioning %q", err, tt.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("render failed: %v", err)
+			}
+
+			if rendered.Text != tt.text {
+				t.Errorf("text = %q, want %q", rendered.Text, tt.text)
+			}
+
+			if tt.example != "" && rendered.Examples[1].Text != tt.example {
+				t.Errorf("first example = %q, want %q", rendered.Examples[1].Text, tt.example)
+			}
+		})
+	}
+}
+
+func TestPromptTemplateVars(t *testing.T) {
+	vars := promptTemplateVars("src/main.go", "", "Go", PromptVars{"audience": "beginners", "Language": "Rust"})
+
+	want := map[string]string{"Filename": "src/main.go", "Basename": "main.go", "Language": "Rust", "audience": "beginners"}
+	for key, value := range want {
+		if vars[key] != value {
+			t.Errorf("%s = %q, want %q", key, vars[key], value)
+		}
+	}
+
+	if vars["Date"] == "" {
+		t.Error("Date is not set")
+	}
+
+	if vars := promptTemplateVars("", "", "", nil); vars["Basename"] != "" {
+		t.Errorf("Basename = %q without a file", vars["Basename"])
+	}
+}
+
+func TestPromptFileExampleNumbering(t *testing.T) {
+	tests := []struct {
+		name     string
+		examples int
+	}{
+		{"none", 0},
+		{"one", 1},
+		{"past nine messages", 6}, // Sorting 10 after 9 needs numbers, not strings
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var file strings.Builder
+			file.WriteString("name: numbered\ntext: Answer briefly\n")
+
+			if tt.examples > 0 {
+				file.WriteString("examples:\n")
+			}
+
+			for i := 1; i <= tt.examples; i++ {
+				fmt.Fprintf(&file, "  - user: question %d\n    assistant: answer %d\n", i, i)
+			}
+
+			path := filepath.Join(t.TempDir(), "numbered.yaml")
+			if err := os.WriteFile(path, []byte(file.String()), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			prompt, err := loadSinglePromptFile(path)
+			if err != nil {
+				t.Fatalf("loading the prompt failed: %v", err)
+			}
+
+			if prompt.exampleCount() != tt.examples {
+				t.Errorf("exampleCount = %d, want %d", prompt.exampleCount(), tt.examples)
+			}
+
+			messages := prompt.exampleMessages()
+			if len(messages) != 2*tt.examples {
+				t.Fatalf("got %d example messages, want %d", len(messages), 2*tt.examples)
+			}
+
+			for i := 1; i <= tt.examples; i++ {
+				user, assistant := messages[2*i-2], messages[2*i-1]
+
+				if user.Role != "user" || user.Content != fmt.Sprintf("question %d", i) {
+					t.Errorf("message %d = %+v, want question %d from the user", 2*i-1, user, i)
+				}
+
+				if assistant.Role != "assistant" || assistant.Content != fmt.Sprintf("answer %d", i) {
+					t.Errorf("message %d = %+v, want answer %d from the assistant", 2*i, assistant, i)
+				}
+			}
+		})
+	}
+}
+
+func TestPromptFileNeedsWholeExamples(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "half.yaml")
+	if err := os.WriteFile(path, []byte("name: half\ntext: Hi\nexamples:\n  - user: only a question\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadPromptFile(path); err == nil || !strings.Contains(err.Error(), "example 1") {
+		t.Errorf("err = %v, want example 1 to need an assistant", err)
+	}
+}
+
+func TestPromptFileTemperature(t *testing.T) {
+	tests := []struct {
+		file    string
+		content string
+		want    string // What describe says about it
+	}{
+		{"unset.yaml", "name: unset\ntext: Hi\n", ""},
+		{"zero.yaml", "name: zero\ntext: Hi\ntemperature: 0\n", "temperature 0"},
+		{"warm.toml", "name = \"warm\"\ntext = \"Hi\"\ntemperature = 0.5\n", "temperature 0.5"},
+	}
+
+	dir := t.TempDir()
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.file)
+		if err := os.WriteFile(path, []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		prompt, err := loadSinglePromptFile(path)
+		if err != nil {
+			t.Fatalf("loading %s failed: %v", tt.file, err)
+		}
+
+		// A temperature of 0 is set, not left to the provider
+		if (prompt.Defaults.Temperature != nil) != (tt.want != "") || prompt.Defaults.describe() != tt.want {
+			t.Errorf("%s: temperature %v, described as %q, want %q", tt.file, prompt.Defaults.Temperature, prompt.Defaults.describe(), tt.want)
+		}
+	}
+}
+
+func TestChainFromFlagsLiteral(t *testing.T) {
+	for _, literal := range []bool{true, false} {
+		chain := chainFromFlags("summarize-text, listify", "Then {{.Language}}", literal)
+
+		if len(chain.Steps) != 3 {
+			t.Fatalf("got %d steps, want 3", len(chain.Steps))
+		}
+
+		if last := chain.Steps[2]; last.Text != "Then {{.Language}}" || last.Literal != literal {
+			t.Errorf("last step = %+v, want the -c text with Literal %v", last, literal)
+		}
+	}
+}
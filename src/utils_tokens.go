@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+/////////////////
+
+// Tokens are counted with OpenAI's tokenizer for OpenAI models. Its encodings
+// are downloaded the first time they are needed and kept in the user's cache
+// directory. Other models, and OpenAI ones when the encoding cannot be had,
+// get an estimate of about four characters a token, which is shown with a ~
+
+// How long we wait for an encoding to download before estimating instead
+const tokenizerDownloadTimeout = 10 * time.Second
+
+// The tokenizers loaded so far, by model. nil when the model has none
+type tokenizerCache struct {
+	mu     sync.Mutex
+	models map[string]*tiktoken.Tiktoken
+}
+
+var tokenizers = newTokenizerCache()
+
+func newTokenizerCache() *tokenizerCache {
+	return &tokenizerCache{models: map[string]*tiktoken.Tiktoken{}}
+}
+
+func init() {
+	tiktoken.SetBpeLoader(cachedBpeLoader{})
+}
+
+// The tokenizer for a model, nil when it has none we can load. A model is
+// only tried once
+func (c *tokenizerCache) forModel(model string) *tiktoken.Tiktoken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if encoding, ok := c.models[model]; ok {
+		return encoding
+	}
+
+	encoding, err := tiktoken.EncodingForModel(model)
+	if err != nil {
+		encoding = nil
+	}
+
+	c.models[model] = encoding
+	return encoding
+}
+
+// How many tokens a text is for the model, and whether that was counted or
+// estimated
+func countTokens(model string, text string) (int, bool) {
+	if encoding := tokenizers.forModel(model); encoding != nil {
+		return len(encoding.Encode(text, nil, nil)), true
+	}
+
+	return estimateTokens(text), false
+}
+
+// How many tokens a list of messages is. Every message costs a few tokens on
+// top of its content, and the answer is primed with a few more
+func countMessagesTokens(model string, messages []ProviderMessage) (int, bool) {
+	total, exact := 3, tokenizers.forModel(model) != nil
+
+	for _, message := range messages {
+		tokens, _ := countTokens(model, message.Content)
+		total += 4 + tokens
+	}
+
+	return total, exact
+}
+
+// Roughly how many tokens a text is
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+/////////////////
+
+// Loads tiktoken's encodings from the cache directory, downloading them there
+// the first time
+type cachedBpeLoader struct{}
+
+func (cachedBpeLoader) LoadTiktokenBpe(url string) (map[string]int, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	file := filepath.Join(cacheDir, "thyme", "tiktoken", path.Base(url))
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if data, err = downloadEncoding(url); err != nil {
+			return nil, err
+		}
+
+		// Without the cache we only download again next time
+		if os.MkdirAll(filepath.Dir(file), 0755) == nil {
+			os.WriteFile(file, data, 0644)
+		}
+	}
+
+	return parseBpeRanks(data)
+}
+
+func downloadEncoding(url string) ([]byte, error) {
+	client := &http.Client{Timeout: tokenizerDownloadTimeout}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("downloading %s: %s", url, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// An encoding file has a base64 token and its rank on every line
+func parseBpeRanks(data []byte) (map[string]int, error) {
+	ranks := map[string]int{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+
+		token, rank, found := strings.Cut(line, " ")
+		if !found {
+			return nil, fmt.Errorf("bad encoding line %q", line)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, err
+		}
+
+		ranks[string(decoded)] = n
+	}
+
+	return ranks, nil
+}
+
+/////////////////
+
+// How many tokens each model can take in, question and answer together
+var modelContextWindows = map[string]int{
+	"gpt-3.5-turbo":     4096,
+	"gpt-3.5-turbo-16k": 16384,
+	"gpt-4":             8192,
+	"gpt-4-0613":        8192,
+	"gpt-4-32k":         32768,
+	"gpt-4-32k-0613":    32768,
+	"llama2":            4096,
+	"llama2:13b":        4096,
+	"llama3":            8192,
+	"codellama":         16384,
+	"mistral":           8192,
+	"mixtral":           32768,
+	"phi":               2048,
+}
+
+// Models we know nothing about are given the smallest common window
+const defaultContextWindow = 4096
+
+// What OpenAI models cost in dollars for 1000 tokens of question and of
+// answer. Local models are free, others we do not know
+type modelPrice struct {
+	Input  float64
+	Output float64
+}
+
+var modelPrices = map[string]modelPrice{
+	"gpt-3.5-turbo":     {0.0015, 0.002},
+	"gpt-3.5-turbo-16k": {0.003, 0.004},
+	"gpt-4":             {0.03, 0.06},
+	"gpt-4-0613":        {0.03, 0.06},
+	"gpt-4-32k":         {0.06, 0.12},
+	"gpt-4-32k-0613":    {0.06, 0.12},
+}
+
+// Roughly what a request cost. False when we do not know the model's price
+func estimateCost(model string, input int, output int, config ThymeConfig) (float64, bool) {
+	if config.usingLocalServer() {
+		return 0, true
+	}
+
+	price, ok := modelPrices[model]
+	if !ok {
+		return 0, false
+	}
+
+	return (float64(input)*price.Input + float64(output)*price.Output) / 1000, true
+}
+
+// What a chat does when the next message would not fit the model
+var contextStrategies = []string{"drop", "summarize", "refuse"}
+
+var contextStrategyDescriptions = map[string]string{
+	"drop":      "leave out the oldest turns",
+	"summarize": "summarize the oldest turns",
+	"refuse":    "refuse to send more",
+}
+
+func isContextStrategy(s string) bool {
+	for _, strategy := range contextStrategies {
+		if s == strategy {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The context window of a model, THYME_CONTEXT_LIMIT when it is set
+func contextWindow(model string, config ThymeConfig) int {
+	if config.ContextLimit > 0 {
+		return config.ContextLimit
+	}
+
+	if limit, ok := modelContextWindows[model]; ok {
+		return limit
+	}
+
+	return defaultContextWindow
+}
+
+// How much of the window is kept free for the answer
+func answerReserve(limit int) int {
+	reserve := limit / 4
+	if reserve > 1024 {
+		reserve = 1024
+	}
+
+	return reserve
+}
+
+// A token count for the chat prompt, like 850 or 3.2k
+func formatTokenCount(tokens int) string {
+	if tokens < 1000 {
+		return fmt.Sprintf("%d", tokens)
+	}
+
+	return fmt.Sprintf("%.1fk", float64(tokens)/1000)
+}
+
+// A count that may have been estimated, like 850 or ~3.2k
+func formatCountedTokens(tokens int, exact bool) string {
+	if exact {
+		return formatTokenCount(tokens)
+	}
+
+	return "~" + formatTokenCount(tokens)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write a tiny encoding to the cache, so the tokenizer loads without a
+// download: every byte, and merges up to "hello"
+func writeTestEncoding(t *testing.T, name string) {
+	cacheDir := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cacheDir)
+	t.Setenv("HOME", cacheDir)
+
+	var file strings.Builder
+	rank := 0
+
+	for b := 0; b < 256; b++ {
+		fmt.Fprintf(&file, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(b)}), rank)
+		rank++
+	}
+
+	for _, merge := range []string{"he", "ll", "hell", "hello"} {
+		fmt.Fprintf(&file, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), rank)
+		rank++
+	}
+
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir = filepath.Join(dir, "thyme", "tiktoken")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, name+".tiktoken"), []byte(file.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCountTokens(t *testing.T) {
+	writeTestEncoding(t, "p50k_base")
+
+	tokenizers = newTokenizerCache()
+	defer func() { tokenizers = newTokenizerCache() }()
+
+	tests := []struct {
+		model  string
+		text   string
+		tokens int
+		exact  bool
+	}{
+		{"text-davinci-003", "hello world", 7, true}, // hello, then every byte of " world"
+		{"text-davinci-003", "", 0, true},
+		{"llama2", "hello world", 3, false}, // Estimated, a token every four characters
+		{"llama2", "日本語です", 2, false},       // Characters, not bytes
+	}
+
+	for _, tt := range tests {
+		tokens, exact := countTokens(tt.model, tt.text)
+
+		if tokens != tt.tokens || exact != tt.exact {
+			t.Errorf("countTokens(%s, %q) = %d, %v, want %d, %v", tt.model, tt.text, tokens, exact, tt.tokens, tt.exact)
+		}
+	}
+
+	messages := buildPromptMessages("hello", nil, "hello world")
+
+	if tokens, exact := countMessagesTokens("text-davinci-003", messages); tokens != 3+4+1+4+7 || !exact {
+		t.Errorf("countMessagesTokens = %d, %v, want %d counted", tokens, exact, 3+4+1+4+7)
+	}
+
+	for _, messages := range [][]ProviderMessage{messages, nil} {
+		if _, exact := countMessagesTokens("llama2", messages); exact {
+			t.Errorf("%d messages of a model without a tokenizer were counted exactly", len(messages))
+		}
+	}
+}
+
+func TestParseBpeRanks(t *testing.T) {
+	ranks, err := parseBpeRanks([]byte("aGVsbG8= 0\nIHdvcmxk 1\n\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ranks) != 2 || ranks["hello"] != 0 || ranks[" world"] != 1 {
+		t.Errorf("ranks = %v", ranks)
+	}
+
+	for _, bad := range []string{"aGVsbG8=", "not-base64! 1", "aGVsbG8= one"} {
+		if _, err := parseBpeRanks([]byte(bad)); err == nil {
+			t.Errorf("parseBpeRanks(%q) did not fail", bad)
+		}
+	}
+}
+
+func TestFormatCountedTokens(t *testing.T) {
+	tests := []struct {
+		tokens int
+		exact  bool
+		want   string
+	}{
+		{850, true, "850"},
+		{850, false, "~850"},
+		{3200, true, "3.2k"},
+		{3240, false, "~3.2k"},
+	}
+
+	for _, tt := range tests {
+		if got := formatCountedTokens(tt.tokens, tt.exact); got != tt.want {
+			t.Errorf("formatCountedTokens(%d, %v) = %q, want %q", tt.tokens, tt.exact, got, tt.want)
+		}
+	}
+}